@@ -0,0 +1,430 @@
+package bma
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+import "unicode"
+
+// Builtins are checks implemented natively in bmad, rather than by forking
+// a command. Each one is given the params and timeout of its Check, and
+// returns its state, a message describing it, and any samples it collected.
+// If it can't collect its data, it returns an error, and the Check is UNKNOWN.
+type builtin struct {
+	required []string                      // params that must be set
+	optional []string                      // params that may be set
+	numbers  []string                      // params that must be numbers
+	validate func(map[string]string) error // additional validation of params, if any
+	run      func(params map[string]string, timeout time.Duration) (int, string, []sample, error)
+}
+
+// Samples are the metrics collected by a builtin, sent to bolo as
+// SAMPLEs for <host>:<check>:<name>
+type sample struct {
+	name  string
+	value float64
+}
+
+// Results of a run of a builtin (or a plugin), sent back from its goroutine
+type builtin_result struct {
+	output  string
+	err_msg string
+	rc      int
+}
+
+// Builtins available to checks, by name
+var builtins = map[string]builtin{
+	"disk": {
+		optional: []string{"mounts", "warn", "crit"},
+		numbers:  []string{"warn", "crit"},
+		run:      builtin_disk,
+	},
+	"load": {
+		optional: []string{"warn", "crit"},
+		numbers:  []string{"warn", "crit"},
+		run:      builtin_load,
+	},
+	"memory": {
+		optional: []string{"warn", "crit", "swap_warn", "swap_crit"},
+		numbers:  []string{"warn", "crit", "swap_warn", "swap_crit"},
+		run:      builtin_memory,
+	},
+	"process": {
+		required: []string{"name"},
+		optional: []string{"min", "max"},
+		numbers:  []string{"min", "max"},
+		run:      builtin_process,
+	},
+	"file": {
+		required: []string{"path"},
+		optional: []string{"warn_age", "crit_age", "warn_size", "crit_size"},
+		numbers:  []string{"warn_age", "crit_age", "warn_size", "crit_size"},
+		run:      builtin_file,
+	},
+	"tcp": {
+		required: []string{"host", "port"},
+		optional: []string{"warn", "crit"},
+		numbers:  []string{"port", "warn", "crit"},
+		validate: validate_tcp,
+		run:      builtin_tcp,
+	},
+	"http": {
+		required: []string{"url"},
+		optional: []string{"status", "match", "insecure", "warn", "crit", "cert_warn", "cert_crit"},
+		numbers:  []string{"status", "warn", "crit", "cert_warn", "cert_crit"},
+		validate: validate_http,
+		run:      builtin_http,
+	},
+	"dns": {
+		required: []string{"name"},
+		optional: []string{"type", "server", "expect", "warn", "crit"},
+		numbers:  []string{"warn", "crit"},
+		validate: validate_dns,
+		run:      builtin_dns,
+	},
+}
+
+// Validates the params of a builtin check, returning an error describing
+// the first problem found
+func validate_builtin(name string, params map[string]string) error {
+	b, ok := builtins[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown builtin `%s`, expected one of: %s", name, strings.Join(builtin_names(), ", ")))
+	}
+	for _, param := range b.required {
+		if params[param] == "" {
+			return errors.New(fmt.Sprintf("Builtin %s requires the %s param", name, param))
+		}
+	}
+	for param := range params {
+		if !contains(b.required, param) && !contains(b.optional, param) {
+			return errors.New(fmt.Sprintf("Unknown param `%s` for builtin %s", param, name))
+		}
+	}
+	for _, param := range b.numbers {
+		if _, err := number_param(params, param, 0); err != nil {
+			return err
+		}
+	}
+	if b.validate != nil {
+		return b.validate(params)
+	}
+	return nil
+}
+
+// Returns the names of all builtins, sorted
+func builtin_names() []string {
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns true if list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of a numeric param, or def if it isn't set
+func number_param(params map[string]string, name string, def float64) (float64, error) {
+	value, ok := params[name]
+	if !ok || value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return def, errors.New(fmt.Sprintf("Invalid %s `%s`, expected a number", name, value))
+	}
+	return n, nil
+}
+
+// Returns the state for value, given its warning and critical thresholds
+// (thresholds that are unset, and have no default, are ignored)
+func threshold(params map[string]string, value float64, warn string, crit string, def_warn float64, def_crit float64) int {
+	if c, set := threshold_param(params, crit, def_crit); set && value >= c {
+		return CRITICAL
+	}
+	if w, set := threshold_param(params, warn, def_warn); set && value >= w {
+		return WARNING
+	}
+	return OK
+}
+
+// Returns the value of a threshold param, and whether the threshold is set.
+// Explicit values (including 0) are always set, while a default of 0 means
+// the threshold is unset unless given.
+func threshold_param(params map[string]string, name string, def float64) (float64, bool) {
+	if params[name] == "" {
+		return def, def > 0
+	}
+	n, err := number_param(params, name, def)
+	return n, err == nil
+}
+
+// Runs the builtin for the Check, returning the lines to send to bolo
+// (as the given host), and the Check's rc
+func (self *Check) run_builtin(host string) builtin_result {
+	rc, msg, samples, err := builtins[self.Builtin].run(self.Params, time.Duration(self.Timeout)*time.Second)
+	if err != nil {
+		rc, msg, samples = UNKNOWN, err.Error(), nil
+	}
+	// messages may include data from elsewhere (like DNS answers, or error
+	// text from remote servers), which mustn't be able to inject extra lines
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	now := time.Now().Unix()
+	output := fmt.Sprintf("STATE %d %s:%s %d %s\n", now, host, self.Name, rc, msg)
+	for _, s := range samples {
+		output += fmt.Sprintf("SAMPLE %d %s:%s:%s %s\n",
+			now, host, self.Name, s.name, strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+	return builtin_result{output: output, rc: rc}
+}
+
+// Returns the worst of two states
+func worst(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Reports the percentage of space used on each mount point listed in the
+// mounts param (comma-separated), or all mounted block devices if unset
+func builtin_disk(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	var mounts []string
+	for _, mount := range strings.Split(params["mounts"], ",") {
+		if mount = strings.TrimSpace(mount); mount != "" {
+			mounts = append(mounts, mount)
+		}
+	}
+	if len(mounts) == 0 {
+		var err error
+		if mounts, err = block_mounts(); err != nil {
+			return UNKNOWN, "", nil, err
+		}
+	}
+
+	rc := OK
+	var msgs []string
+	var samples []sample
+	for _, mount := range mounts {
+		total, used, avail, err := disk_usage(mount)
+		if err != nil {
+			return UNKNOWN, "", nil, errors.New(fmt.Sprintf("Unable to check disk usage of %s: %s", mount, err.Error()))
+		}
+		pct := 0.0
+		if used+avail > 0 {
+			pct = float64(used) * 100 / float64(used+avail)
+		}
+		rc = worst(rc, threshold(params, pct, "warn", "crit", 80, 90))
+		msgs = append(msgs, fmt.Sprintf("%s %0.1f%% used", mount, pct))
+		name := mount_name(mount)
+		samples = append(samples,
+			sample{name + ":used-pct", round(pct)},
+			sample{name + ":total-bytes", float64(total)},
+			sample{name + ":used-bytes", float64(used)},
+			sample{name + ":free-bytes", float64(avail)})
+	}
+	return rc, strings.Join(msgs, ", "), samples, nil
+}
+
+// Returns the name to sample a mount point's usage as, since bolo
+// metric names can't contain slashes or whitespace (/ is sampled as
+// root, /var as var, /var/log as var-log, and so on)
+func mount_name(mount string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '-'
+		case unicode.IsSpace(r):
+			return '_'
+		}
+		return r
+	}, strings.Trim(mount, "/"))
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// Returns the mount points of all block devices, from /proc/mounts
+func block_mounts() ([]string, error) {
+	f, err := os.Open(filepath.Join(proc_root, "mounts"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") || contains(mounts, fields[1]) {
+			continue
+		}
+		mounts = append(mounts, fields[1])
+	}
+	return mounts, scanner.Err()
+}
+
+// Reports the load averages, from /proc/loadavg. The thresholds
+// apply to the 1-minute load average.
+func builtin_load(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	source, err := ioutil.ReadFile(filepath.Join(proc_root, "loadavg"))
+	if err != nil {
+		return UNKNOWN, "", nil, err
+	}
+	fields := strings.Fields(string(source))
+	if len(fields) < 3 {
+		return UNKNOWN, "", nil, errors.New(fmt.Sprintf("Unable to parse load averages `%s`", strings.TrimSpace(string(source))))
+	}
+	var load [3]float64
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return UNKNOWN, "", nil, errors.New(fmt.Sprintf("Unable to parse load averages `%s`", strings.TrimSpace(string(source))))
+		}
+	}
+	rc := threshold(params, load[0], "warn", "crit", 0, 0)
+	return rc, fmt.Sprintf("load average: %0.2f, %0.2f, %0.2f", load[0], load[1], load[2]), []sample{
+		{"load1", load[0]},
+		{"load5", load[1]},
+		{"load15", load[2]},
+	}, nil
+}
+
+// Reports the percentage of memory and swap used, from /proc/meminfo
+func builtin_memory(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	info, err := read_meminfo()
+	if err != nil {
+		return UNKNOWN, "", nil, err
+	}
+	total, ok := info["MemTotal"]
+	if !ok || total == 0 {
+		return UNKNOWN, "", nil, errors.New("Unable to find MemTotal in meminfo")
+	}
+	available, ok := info["MemAvailable"]
+	if !ok {
+		// kernels before 3.14 don't estimate available memory
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	pct := float64(total-available) * 100 / float64(total)
+	rc := threshold(params, pct, "warn", "crit", 90, 95)
+	msg := fmt.Sprintf("%0.1f%% of memory used", pct)
+	samples := []sample{
+		{"memory-used-pct", round(pct)},
+		{"memory-total-bytes", float64(total)},
+		{"memory-available-bytes", float64(available)},
+	}
+
+	swap_total, swap_free := info["SwapTotal"], info["SwapFree"]
+	if swap_total > 0 {
+		swap_pct := float64(swap_total-swap_free) * 100 / float64(swap_total)
+		rc = worst(rc, threshold(params, swap_pct, "swap_warn", "swap_crit", 0, 0))
+		msg = fmt.Sprintf("%s, %0.1f%% of swap used", msg, swap_pct)
+		samples = append(samples,
+			sample{"swap-used-pct", round(swap_pct)},
+			sample{"swap-total-bytes", float64(swap_total)},
+			sample{"swap-free-bytes", float64(swap_free)})
+	}
+	return rc, msg, samples, nil
+}
+
+// Parses /proc/meminfo into a map of field names to values (in bytes)
+func read_meminfo() (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(proc_root, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.Replace(scanner.Text(), ":", " ", 1))
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		info[fields[0]] = value
+	}
+	return info, scanner.Err()
+}
+
+// Reports whether processes with the given name (as seen in
+// /proc/<pid>/stat) are running. At least min (default 1), and at
+// most max (if set) processes are expected.
+func builtin_process(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	procs, err := list_processes()
+	if err != nil {
+		return UNKNOWN, "", nil, err
+	}
+	count := 0
+	for _, p := range procs {
+		if p.comm == params["name"] {
+			count++
+		}
+	}
+
+	min, _ := number_param(params, "min", 1)
+	max, _ := number_param(params, "max", -1)
+	rc := OK
+	msg := fmt.Sprintf("%d %s processes running", count, params["name"])
+	if float64(count) < min {
+		rc = CRITICAL
+		msg = fmt.Sprintf("%s (expected at least %g)", msg, min)
+	} else if max >= 0 && float64(count) > max {
+		rc = CRITICAL
+		msg = fmt.Sprintf("%s (expected at most %g)", msg, max)
+	}
+	return rc, msg, []sample{{"count", float64(count)}}, nil
+}
+
+// Reports the age (since it was last modified, in seconds) and size
+// (in bytes) of a file. Missing files are CRITICAL.
+func builtin_file(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	path := params["path"]
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return CRITICAL, fmt.Sprintf("%s does not exist", path), nil, nil
+	}
+	if err != nil {
+		return UNKNOWN, "", nil, err
+	}
+
+	age := time.Since(info.ModTime()).Seconds()
+	if age < 0 {
+		age = 0
+	}
+	size := float64(info.Size())
+	rc := worst(threshold(params, age, "warn_age", "crit_age", 0, 0),
+		threshold(params, size, "warn_size", "crit_size", 0, 0))
+	return rc, fmt.Sprintf("%s is %ds old, and %d bytes", path, int64(age), info.Size()), []sample{
+		{"age", float64(int64(age))},
+		{"size", size},
+	}, nil
+}
+
+// Rounds a percentage to 2 decimal places
+func round(n float64) float64 {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(n, 'f', 2, 64), 64)
+	return r
+}
@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "syscall"
+
+// Function-variable for finding the total, used, and available space (in bytes)
+// of the filesystem mounted at path (used for mocking during tests)
+var disk_usage = func(path string) (uint64, uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(fs.Bsize)
+	return fs.Blocks * bsize, (fs.Blocks - fs.Bfree) * bsize, fs.Bavail * bsize, nil
+}
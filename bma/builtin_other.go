@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package bma
+
+import "errors"
+
+// The disk builtin is only supported on Linux
+var disk_usage = func(path string) (uint64, uint64, uint64, error) {
+	return 0, 0, 0, errors.New("the disk builtin is only supported on Linux")
+}
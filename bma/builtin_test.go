@@ -0,0 +1,236 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "errors"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "time"
+
+func Test_validate_builtin(t *testing.T) {
+	assert.NoError(t, validate_builtin("load", nil), "builtins with no required params need no params")
+	assert.NoError(t, validate_builtin("disk", map[string]string{"mounts": "/,/var", "warn": "70", "crit": "85.5"}),
+		"valid params are accepted")
+
+	assert.EqualError(t, validate_builtin("uptime", nil),
+		"Unknown builtin `uptime`, expected one of: disk, dns, file, http, load, memory, process, tcp", "unknown builtins are rejected")
+	assert.EqualError(t, validate_builtin("file", map[string]string{"warn_age": "60"}),
+		"Builtin file requires the path param", "missing required params are rejected")
+	assert.EqualError(t, validate_builtin("load", map[string]string{"warning": "4"}),
+		"Unknown param `warning` for builtin load", "unknown params are rejected")
+	assert.EqualError(t, validate_builtin("memory", map[string]string{"swap_crit": "90%"}),
+		"Invalid swap_crit `90%`, expected a number", "non-numeric thresholds are rejected")
+}
+
+func Test_builtin_disk(t *testing.T) {
+	orig_proc_root := proc_root
+	orig_disk_usage := disk_usage
+	proc_root = "t/data/proc"
+	defer func () {
+		proc_root = orig_proc_root
+		disk_usage = orig_disk_usage
+	}()
+
+	usage := map[string][]uint64{
+		"/":    { 1000, 500, 500 },
+		"/var": { 1000, 850, 150 },
+	}
+	disk_usage = func (path string) (uint64, uint64, uint64, error) {
+		u, ok := usage[path]
+		if !ok {
+			return 0, 0, 0, errors.New("no such file or directory")
+		}
+		return u[0], u[1], u[2], nil
+	}
+
+	rc, msg, samples, err := builtin_disk(map[string]string{}, 0)
+	assert.NoError(t, err, "No errors checking disk usage")
+	assert.Equal(t, WARNING, rc, "disk usage over the default warning threshold is WARNING")
+	assert.Equal(t, "/ 50.0% used, /var 85.0% used", msg, "block devices are found in /proc/mounts")
+	assert.Equal(t, []sample{
+		{ "root:used-pct",    50 },
+		{ "root:total-bytes", 1000 },
+		{ "root:used-bytes",  500 },
+		{ "root:free-bytes",  500 },
+		{ "var:used-pct",     85 },
+		{ "var:total-bytes",  1000 },
+		{ "var:used-bytes",   850 },
+		{ "var:free-bytes",   150 },
+	}, samples, "usage of each mount is sampled, named after the mount point")
+
+	rc, msg, _, err = builtin_disk(map[string]string{"mounts": " / ", "warn": "40", "crit": "50"}, 0)
+	assert.NoError(t, err, "No errors checking disk usage")
+	assert.Equal(t, CRITICAL, rc, "thresholds can be set via params")
+	assert.Equal(t, "/ 50.0% used", msg, "only the listed mounts are checked")
+
+	rc, _, _, err = builtin_disk(map[string]string{"mounts": "/var", "warn": "", "crit": "0"}, 0)
+	assert.NoError(t, err, "No errors checking disk usage")
+	assert.Equal(t, CRITICAL, rc, "explicit thresholds of 0 override the defaults")
+
+	_, _, _, err = builtin_disk(map[string]string{"mounts": "/nfs"}, 0)
+	assert.EqualError(t, err, "Unable to check disk usage of /nfs: no such file or directory",
+		"mounts that can't be checked return an error")
+}
+
+func Test_mount_name(t *testing.T) {
+	assert.Equal(t, "root", mount_name("/"), "/ is named root")
+	assert.Equal(t, "var", mount_name("/var"), "leading slashes are dropped")
+	assert.Equal(t, "var-log", mount_name("/var/log/"), "inner slashes become dashes, and trailing slashes are dropped")
+	assert.Equal(t, "mnt-my_disk", mount_name("/mnt/my disk"), "whitespace becomes underscores")
+}
+
+func Test_builtin_load(t *testing.T) {
+	orig_proc_root := proc_root
+	proc_root = "t/data/proc"
+	defer func () { proc_root = orig_proc_root }()
+
+	rc, msg, samples, err := builtin_load(map[string]string{}, 0)
+	assert.NoError(t, err, "No errors checking load averages")
+	assert.Equal(t, OK, rc, "load is OK without thresholds")
+	assert.Equal(t, "load average: 1.52, 0.98, 0.50", msg, "load averages are reported")
+	assert.Equal(t, []sample{{ "load1", 1.52 }, { "load5", 0.98 }, { "load15", 0.5 }}, samples,
+		"load averages are sampled")
+
+	rc, _, _, _ = builtin_load(map[string]string{"warn": "1.5", "crit": "4"}, 0)
+	assert.Equal(t, WARNING, rc, "1-minute load is compared to warn")
+	rc, _, _, _ = builtin_load(map[string]string{"warn": "1", "crit": "1.5"}, 0)
+	assert.Equal(t, CRITICAL, rc, "1-minute load is compared to crit")
+	rc, _, _, _ = builtin_load(map[string]string{"warn": "0"}, 0)
+	assert.Equal(t, WARNING, rc, "explicit thresholds of 0 are not ignored")
+
+	proc_root = "t/data/nonexistent"
+	_, _, _, err = builtin_load(map[string]string{}, 0)
+	assert.Error(t, err, "missing /proc/loadavg returns an error")
+}
+
+func Test_builtin_memory(t *testing.T) {
+	orig_proc_root := proc_root
+	proc_root = "t/data/proc"
+	defer func () { proc_root = orig_proc_root }()
+
+	rc, msg, samples, err := builtin_memory(map[string]string{}, 0)
+	assert.NoError(t, err, "No errors checking memory usage")
+	assert.Equal(t, OK, rc, "memory usage under the default thresholds is OK")
+	assert.Equal(t, "75.0% of memory used, 25.0% of swap used", msg, "memory and swap usage are reported")
+	assert.Equal(t, []sample{
+		{ "memory-used-pct",        75 },
+		{ "memory-total-bytes",     1024000000 },
+		{ "memory-available-bytes", 256000000 },
+		{ "swap-used-pct",          25 },
+		{ "swap-total-bytes",       204800000 },
+		{ "swap-free-bytes",        153600000 },
+	}, samples, "memory and swap usage are sampled, in bytes")
+
+	rc, _, _, _ = builtin_memory(map[string]string{"warn": "70"}, 0)
+	assert.Equal(t, WARNING, rc, "memory usage is compared to warn")
+	rc, _, _, _ = builtin_memory(map[string]string{"swap_crit": "20"}, 0)
+	assert.Equal(t, CRITICAL, rc, "swap usage is compared to swap_crit")
+
+	proc_root = "t/data/nonexistent"
+	_, _, _, err = builtin_memory(map[string]string{}, 0)
+	assert.Error(t, err, "missing /proc/meminfo returns an error")
+}
+
+func Test_builtin_process(t *testing.T) {
+	orig_proc_root := proc_root
+	proc_root = "t/data/proc"
+	defer func () { proc_root = orig_proc_root }()
+
+	rc, msg, samples, err := builtin_process(map[string]string{"name": "test_check"}, 0)
+	assert.NoError(t, err, "No errors counting processes")
+	assert.Equal(t, OK, rc, "running processes are OK")
+	assert.Equal(t, "1 test_check processes running", msg, "processes are counted")
+	assert.Equal(t, []sample{{ "count", 1 }}, samples, "process count is sampled")
+
+	rc, msg, _, _ = builtin_process(map[string]string{"name": "zombie"}, 0)
+	assert.Equal(t, CRITICAL, rc, "zombies don't count as running")
+	assert.Equal(t, "0 zombie processes running (expected at least 1)", msg, "missing processes are reported")
+
+	rc, msg, _, _ = builtin_process(map[string]string{"name": "other", "min": "0", "max": "0"}, 0)
+	assert.Equal(t, CRITICAL, rc, "too many processes are CRITICAL")
+	assert.Equal(t, "1 other processes running (expected at most 0)", msg, "too many processes are reported")
+}
+
+func Test_builtin_file(t *testing.T) {
+	f, err := ioutil.TempFile("", "bmad-builtin")
+	if err != nil {
+		t.Fatalf("Couldn't create temp file: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hello\n")
+	f.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(f.Name(), old, old)
+
+	rc, _, samples, err := builtin_file(map[string]string{"path": f.Name()}, 0)
+	assert.NoError(t, err, "No errors checking files")
+	assert.Equal(t, OK, rc, "files are OK without thresholds")
+	assert.InDelta(t, 7200, samples[0].value, 5, "file age is sampled")
+	assert.Equal(t, sample{ "size", 6 }, samples[1], "file size is sampled")
+
+	rc, _, _, _ = builtin_file(map[string]string{"path": f.Name(), "warn_age": "3600", "crit_age": "86400"}, 0)
+	assert.Equal(t, WARNING, rc, "old files are WARNING")
+	rc, _, _, _ = builtin_file(map[string]string{"path": f.Name(), "crit_size": "5"}, 0)
+	assert.Equal(t, CRITICAL, rc, "large files are CRITICAL")
+
+	rc, msg, _, err := builtin_file(map[string]string{"path": "t/data/nonexistent"}, 0)
+	assert.NoError(t, err, "No errors checking missing files")
+	assert.Equal(t, CRITICAL, rc, "missing files are CRITICAL")
+	assert.Equal(t, "t/data/nonexistent does not exist", msg, "missing files are reported")
+}
+
+func Test_builtin_check(t *testing.T) {
+	orig_proc_root := proc_root
+	proc_root = "t/data/proc"
+	defer func () { proc_root = orig_proc_root }()
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+
+	check := Check{
+		Name:    "load",
+		Builtin: "load",
+		Params:  map[string]string{"warn": "1"},
+		Every:   300,
+		Timeout: 20,
+	}
+	err := check.Spawn()
+	assert.NoError(t, err, "No errors spawning builtin checks")
+	assert.True(t, check.running, "builtin check is running")
+	assert.Nil(t, check.process, "builtin checks have no process")
+	assert.Error(t, check.Spawn(), "builtin checks can't be spawned while running")
+
+	var finished bool
+	for i := 0; i < 100 && !finished; i++ {
+		time.Sleep(10 * time.Millisecond)
+		finished = check.Reap()
+	}
+	assert.True(t, finished, "builtin check finished")
+	assert.False(t, check.running, "builtin check is no longer running")
+	assert.Equal(t, WARNING, check.rc, "builtin check rc is its state")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:load 1 load average: 1.52, 0.98, 0.50\n"+
+		"SAMPLE \\d+ test01.example.com:load:load1 1.52\n"+
+		"SAMPLE \\d+ test01.example.com:load:load5 0.98\n"+
+		"SAMPLE \\d+ test01.example.com:load:load15 0.5\n$"), check.output,
+		"builtin check output is bolo data")
+	assert.True(t, check.next_run.After(time.Now()), "builtin check is rescheduled")
+
+	output := check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("STATE \\d+ test01.example.com:load 1 load average"), output,
+		"builtin check state is sent to bolo")
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:load:exec-time "), output,
+		"builtin check runtime is sent to bolo")
+	assert.NotContains(t, output, "orphans", "builtin checks have no orphans")
+
+	// builtins that hang are abandoned once they time out
+	check.Timeout = 0
+	check.running = true
+	check.started_at = time.Now().Add(-1 * time.Second)
+	check.builtin = make(chan builtin_result, 1)
+	assert.True(t, check.Reap(), "hung builtin check is reaped")
+	assert.Equal(t, UNKNOWN, check.rc, "hung builtin check is UNKNOWN")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:load 3 load timed out after 0s\n$"), check.output,
+		"hung builtin check reports its timeout")
+	assert.True(t, check.timed_out(), "hung builtin check counts as a timeout")
+}
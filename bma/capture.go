@@ -0,0 +1,117 @@
+package bma
+
+import "bytes"
+import "os"
+import "time"
+
+// Maximum time to wait for a check's output to be drained, once it
+// has exited (anything it left running may be holding the pipes open)
+const CAPTURE_GRACE time.Duration = 250 * time.Millisecond
+
+// Captures collect the output of a Check from one of its pipes, keeping
+// at most limit bytes of it (0 for no limit). Once the limit is hit, the
+// capture is marked as truncated, and anything else the check writes is
+// read and discarded, so the check doesn't block on a full pipe.
+//
+// If lines is set, each complete line of output is passed to it as soon
+// as it's read, rather than buffered. Only the current (partial) line is
+// kept, and lines longer than the limit are discarded.
+type capture struct {
+	reader    *os.File
+	buffer    bytes.Buffer
+	limit     int64
+	truncated bool
+	done      chan bool
+	lines     func(string)
+	skip_line bool // discarding the rest of a line that was too long to stream
+}
+
+// Creates a capture, returning it along with the write end of its pipe,
+// to be handed to the check's process
+func new_capture(limit int64) (*capture, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &capture{reader: r, limit: limit, done: make(chan bool)}, w, nil
+}
+
+// Starts reading the check's output from the pipe, in the background
+func (c *capture) start() {
+	go func() {
+		defer close(c.done)
+		chunk := make([]byte, 32*1024)
+		for {
+			n, err := c.reader.Read(chunk)
+			if n > 0 {
+				c.store(chunk[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Adds data to the buffer, up to the limit of the capture
+func (c *capture) store(data []byte) {
+	if c.lines != nil {
+		c.stream(data)
+		return
+	}
+	if c.limit > 0 {
+		room := c.limit - int64(c.buffer.Len())
+		if int64(len(data)) > room {
+			data = data[:room]
+			c.truncated = true
+		}
+	}
+	c.buffer.Write(data)
+}
+
+// Passes each complete line in data (prefixed by any partial line
+// buffered from previous reads) to the lines function of the capture
+func (c *capture) stream(data []byte) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		line := data
+		if end >= 0 {
+			line = data[:end+1]
+		}
+		data = data[len(line):]
+
+		if c.skip_line {
+			c.skip_line = end < 0
+			continue
+		}
+		if c.limit > 0 && int64(c.buffer.Len()+len(line)) > c.limit {
+			c.truncated = true
+			c.buffer.Reset()
+			c.skip_line = end < 0
+			continue
+		}
+		c.buffer.Write(line)
+		if end >= 0 {
+			c.lines(c.buffer.String())
+			c.buffer.Reset()
+		}
+	}
+}
+
+// Waits for the check's output to be drained (for up to grace), closes
+// the pipe, and returns the captured output, and whether it was truncated
+func (c *capture) finish(grace time.Duration) (string, bool) {
+	select {
+	case <-c.done:
+	case <-time.After(grace):
+		c.reader.Close()
+		<-c.done
+	}
+	c.reader.Close()
+	return c.buffer.String(), c.truncated
+}
+
+// Discards the capture, if the check's process couldn't be started
+func (c *capture) abandon() {
+	c.reader.Close()
+}
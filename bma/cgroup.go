@@ -0,0 +1,140 @@
+package bma
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+// Cgroups describe where (and with what limits) to run Checks in the
+// cgroup v2 hierarchy. Each Check is run in its own cgroup, beneath
+// the cgroup for its Group, so that Checks in the same Group share
+// the Group's limits, while resource usage is tracked per-Check:
+//
+//	<root>/<group>/<check name>
+type Cgroup struct {
+	Root       string // cgroup (v2) directory to create check cgroups beneath, e.g. /sys/fs/cgroup/bmad
+	Group      string // Name of the cgroup to run the Check in, shared with other Checks (defaults to the Check name)
+	Cpu_max    string // CPU bandwidth limit for the group, as written to cpu.max, e.g. "50000 100000" (50%)
+	Memory_max string // Memory limit for the group, as written to memory.max, e.g. 256M
+}
+
+// Matches valid cpu.max and memory.max values
+var cpu_max_setting = regexp.MustCompile(`^(max|[0-9]+)( [0-9]+)?$`)
+var memory_max_setting = regexp.MustCompile(`^(max|[0-9]+[KMGkmg]?)$`)
+
+// Validates the cgroup settings, returning an error describing the first problem found
+func (c Cgroup) validate() error {
+	if c.Root == "" {
+		if c.Group != "" || c.Cpu_max != "" || c.Memory_max != "" {
+			return errors.New("cgroup settings require a cgroup root")
+		}
+		return nil
+	}
+	if !filepath.IsAbs(c.Root) {
+		return errors.New(fmt.Sprintf("Invalid cgroup root `%s`, expected an absolute path", c.Root))
+	}
+	if c.Group != "" && (strings.Contains(c.Group, "/") || c.Group == "." || c.Group == "..") {
+		return errors.New(fmt.Sprintf("Invalid cgroup group `%s`, expected a cgroup name", c.Group))
+	}
+	if c.Cpu_max != "" && !cpu_max_setting.MatchString(c.Cpu_max) {
+		return errors.New(fmt.Sprintf("Invalid cgroup cpu_max `%s`, expected '<quota> <period>' or 'max'", c.Cpu_max))
+	}
+	if c.Memory_max != "" && !memory_max_setting.MatchString(c.Memory_max) {
+		return errors.New(fmt.Sprintf("Invalid cgroup memory_max `%s`, expected a size (e.g. 256M) or 'max'", c.Memory_max))
+	}
+	return nil
+}
+
+// Creates the cgroups needed to run the named check (if they don't
+// already exist), applying the group's limits. Returns the path to
+// the check's own cgroup, for its process to be placed in.
+func setup_cgroup(c Cgroup, name string) (string, error) {
+	group := c.Group
+	if group == "" {
+		group = name
+	}
+	group_dir := filepath.Join(c.Root, group)
+	if err := os.MkdirAll(group_dir, 0755); err != nil {
+		return "", err
+	}
+	if !is_cgroup2(group_dir) {
+		return "", errors.New(fmt.Sprintf("%s is not on a cgroup v2 filesystem", c.Root))
+	}
+
+	// controllers must be enabled by the parent of any cgroup using them.
+	// Failures are caught when writing the limits, since memory accounting
+	// is optional.
+	controllers := "+memory"
+	if c.Cpu_max != "" {
+		controllers += " +cpu"
+	}
+	write_cgroup_file(c.Root, "cgroup.subtree_control", controllers)
+	if c.Cpu_max != "" {
+		if err := write_cgroup_file(group_dir, "cpu.max", c.Cpu_max); err != nil {
+			return "", err
+		}
+	}
+	if c.Memory_max != "" {
+		if err := write_cgroup_file(group_dir, "memory.max", c.Memory_max); err != nil {
+			return "", err
+		}
+	}
+	write_cgroup_file(group_dir, "cgroup.subtree_control", "+memory")
+
+	leaf := filepath.Join(group_dir, name)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return leaf, nil
+}
+
+// Writes value to a cgroup interface file
+func write_cgroup_file(dir string, file string, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(value); err != nil {
+		return errors.New(fmt.Sprintf("Unable to write `%s` to %s: %s", value, filepath.Join(dir, file), err.Error()))
+	}
+	return nil
+}
+
+// Returns the total CPU time used by the processes in a cgroup (from
+// cpu.stat), and their peak memory usage in bytes (from memory.peak),
+// or -1 if memory accounting isn't enabled for the cgroup
+func cgroup_usage(dir string) (time.Duration, int64, error) {
+	f, err := os.Open(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, -1, err
+	}
+	defer f.Close()
+
+	var cpu time.Duration
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, -1, errors.New(fmt.Sprintf("Invalid usage_usec in %s/cpu.stat: %s", dir, err.Error()))
+			}
+			cpu = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	memory := int64(-1)
+	if peak, err := ioutil.ReadFile(filepath.Join(dir, "memory.peak")); err == nil {
+		if bytes, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64); err == nil {
+			memory = bytes
+		}
+	}
+	return cpu, memory, nil
+}
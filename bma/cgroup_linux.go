@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "os/exec"
+import "syscall"
+
+// statfs(2) filesystem type of cgroup v2 mounts
+const CGROUP2_SUPER_MAGIC int64 = 0x63677270
+
+// Function-variable for determining if a directory is part of
+// the cgroup v2 hierarchy (used for mocking during tests)
+var is_cgroup2 = func(dir string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return false
+	}
+	return int64(fs.Type) == CGROUP2_SUPER_MAGIC
+}
+
+// Arranges for a check's process to be spawned directly into
+// the cgroup at dir, so that none of its children can escape it
+func attach_cgroup(process *exec.Cmd, dir string) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	process.SysProcAttr.UseCgroupFD = true
+	process.SysProcAttr.CgroupFD = fd
+	return nil
+}
+
+// Closes the cgroup descriptor used to spawn a process (if any)
+func release_cgroup(process *exec.Cmd) {
+	if process.SysProcAttr.UseCgroupFD {
+		syscall.Close(process.SysProcAttr.CgroupFD)
+		process.SysProcAttr.UseCgroupFD = false
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package bma
+
+import "errors"
+import "os/exec"
+
+// cgroups are a Linux feature
+var is_cgroup2 = func(dir string) bool {
+	return false
+}
+
+// cgroups are unsupported on this platform
+func attach_cgroup(process *exec.Cmd, dir string) error {
+	return errors.New("cgroups are only supported on Linux")
+}
+
+// Nothing to release, since cgroups are unsupported on this platform
+func release_cgroup(process *exec.Cmd) {}
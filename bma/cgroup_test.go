@@ -0,0 +1,159 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/user"
+import "regexp"
+import "time"
+
+func Test_Cgroup_validate(t *testing.T) {
+	assert.NoError(t, Cgroup{}.validate(), "empty cgroup settings are valid")
+	assert.NoError(t, Cgroup{Root: "/sys/fs/cgroup/bmad", Group: "collectors", Cpu_max: "50000 100000",
+		Memory_max: "256M"}.validate(), "valid cgroup settings validate")
+	assert.NoError(t, Cgroup{Root: "/sys/fs/cgroup/bmad", Cpu_max: "max", Memory_max: "max"}.validate(),
+		"unlimited cgroup settings validate")
+	assert.EqualError(t, Cgroup{Memory_max: "256M"}.validate(), "cgroup settings require a cgroup root",
+		"cgroup limits without a root are invalid")
+	assert.EqualError(t, Cgroup{Root: "bmad"}.validate(), "Invalid cgroup root `bmad`, expected an absolute path",
+		"relative cgroup roots are invalid")
+	assert.EqualError(t, Cgroup{Root: "/sys/fs/cgroup/bmad", Group: "../escape"}.validate(),
+		"Invalid cgroup group `../escape`, expected a cgroup name", "cgroup groups must be names")
+	assert.EqualError(t, Cgroup{Root: "/sys/fs/cgroup/bmad", Cpu_max: "50%"}.validate(),
+		"Invalid cgroup cpu_max `50%`, expected '<quota> <period>' or 'max'", "invalid cpu_max values are invalid")
+	assert.EqualError(t, Cgroup{Root: "/sys/fs/cgroup/bmad", Memory_max: "lots"}.validate(),
+		"Invalid cgroup memory_max `lots`, expected a size (e.g. 256M) or 'max'", "invalid memory_max values are invalid")
+}
+
+func Test_cgroup_usage(t *testing.T) {
+	cpu, memory, err := cgroup_usage("t/data/cgroup/accounted")
+	assert.NoError(t, err, "No errors reading cgroup usage")
+	assert.Equal(t, 1523 * time.Millisecond, cpu, "cpu usage is read from cpu.stat")
+	assert.Equal(t, int64(4194304), memory, "peak memory usage is read from memory.peak")
+
+	cpu, memory, err = cgroup_usage("t/data/cgroup/cpu_only")
+	assert.NoError(t, err, "No errors reading cgroup usage without memory accounting")
+	assert.Equal(t, 250 * time.Microsecond, cpu, "cpu usage is read from cpu.stat")
+	assert.Equal(t, int64(-1), memory, "peak memory usage is -1 without memory accounting")
+
+	_, _, err = cgroup_usage("t/data/cgroup/nonexistent")
+	assert.Error(t, err, "reading usage of a nonexistent cgroup returns an error")
+}
+
+// Creates a fake cgroup filesystem, with the interface files bmad writes to
+func fake_cgroup(t *testing.T) string {
+	root, err := ioutil.TempDir("", "bmad-cgroup")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err.Error())
+	}
+	os.Mkdir(root + "/collectors", 0755)
+	for _, file := range []string{"/cgroup.subtree_control", "/collectors/cgroup.subtree_control",
+		"/collectors/cpu.max", "/collectors/memory.max"} {
+		ioutil.WriteFile(root + file, []byte{}, 0644)
+	}
+	return root
+}
+
+func Test_setup_cgroup(t *testing.T) {
+	root := fake_cgroup(t)
+	defer os.RemoveAll(root)
+
+	c := Cgroup{Root: root, Group: "collectors", Cpu_max: "50000 100000", Memory_max: "256M"}
+	_, err := setup_cgroup(c, "test_check")
+	assert.EqualError(t, err, root + " is not on a cgroup v2 filesystem", "setup_cgroup() requires cgroup v2")
+
+	orig_is_cgroup2 := is_cgroup2
+	is_cgroup2 = func (dir string) bool { return true }
+	defer func () { is_cgroup2 = orig_is_cgroup2 }()
+
+	leaf, err := setup_cgroup(c, "test_check")
+	assert.NoError(t, err, "No errors setting up cgroup")
+	assert.Equal(t, root + "/collectors/test_check", leaf, "checks get their own cgroup beneath their group")
+	assert.DirExists(t, leaf, "the check's cgroup is created")
+	for file, expect := range map[string]string{
+		"/cgroup.subtree_control":            "+memory +cpu",
+		"/collectors/cgroup.subtree_control": "+memory",
+		"/collectors/cpu.max":                "50000 100000",
+		"/collectors/memory.max":             "256M",
+	} {
+		got, _ := ioutil.ReadFile(root + file)
+		assert.Equal(t, expect, string(got), "setup_cgroup() writes %s", file)
+	}
+
+	leaf, err = setup_cgroup(c, "test_check")
+	assert.NoError(t, err, "setup_cgroup() can reuse existing cgroups")
+
+	_, err = setup_cgroup(Cgroup{Root: root, Memory_max: "256M"}, "no_memory")
+	assert.Error(t, err, "setup_cgroup() fails if limits can't be applied")
+}
+
+func Test_cgroup_fallback(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	root := fake_cgroup(t)
+	defer os.RemoveAll(root)
+
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_check", "0"},
+		Name:     "test_check",
+		Every:    300,
+		Timeout:  20,
+		Cgroup:   Cgroup{Root: root, Group: "collectors"},
+	}
+	whoami, err := user.Current()
+	if err != nil {
+		t.Fatalf("Couldn't find current user. Bailing out: %s", err.Error())
+	}
+	expect_out := fmt.Sprintf("VAR1 \nRunning as '%s'\n", whoami.Username)
+
+	check.test(t, expect_out, 0, "check in a non-cgroup directory")
+	assert.True(t, check.cgroup_skip, "cgroups are skipped once they can't be set up")
+	assert.False(t, check.accounted, "checks run without cgroups aren't accounted")
+
+	orig_is_cgroup2 := is_cgroup2
+	is_cgroup2 = func (dir string) bool { return true }
+	defer func () { is_cgroup2 = orig_is_cgroup2 }()
+
+	// spawning into a directory that isn't really a cgroup fails,
+	// just like on a kernel without support for clone3(CLONE_INTO_CGROUP)
+	check.cgroup_skip = false
+	check.test(t, expect_out, 0, "check that can't be spawned into its cgroup")
+	assert.True(t, check.cgroup_skip, "cgroups are skipped once checks can't be spawned into them")
+	assert.False(t, check.accounted, "checks run without cgroups aren't accounted")
+}
+
+func Test_cgroup_samples(t *testing.T) {
+	check := Check{
+		Name:        "test_check",
+		output:      "myoutput\n",
+		duration:    time.Duration(42 * time.Second),
+		cpu_time:    time.Duration(1500 * time.Millisecond),
+		memory_peak: 4194304,
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+
+	output := check.test_submission(t, false, 1024)
+	assert.NotRegexp(t, regexp.MustCompile("bmad:test_check:(cpu-time|memory-peak)"), output,
+		"resource usage isn't reported for checks that weren't accounted")
+
+	check.accounted = true
+	output = check.test_submission(t, false, 1024)
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_check:cpu-time 1.5000"), output,
+		"cpu time is reported for accounted checks")
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_check:memory-peak 4194304"), output,
+		"peak memory is reported for accounted checks")
+
+	check.memory_peak = -1
+	output = check.test_submission(t, false, 1024)
+	assert.NotRegexp(t, regexp.MustCompile("memory-peak"), output,
+		"peak memory isn't reported without memory accounting")
+}
@@ -1,9 +1,10 @@
 package bma
 
 import "github.com/starkandwayne/goutils/log"
-import "bytes"
+import "encoding/json"
 import "errors"
 import "fmt"
+import "os"
 import "os/exec"
 import "os/user"
 import "strings"
@@ -26,25 +27,55 @@ import "time"
 // metric, or state up to bolo, and thus state meta-checks are
 // disallowed.
 type Check struct {
-	Command     string            // Command to execute for this Check
-	Every       int64             // Specific interval at which to run this Check (in seconds)
-	Retries     int               // Number of times to retry this Check after failure
-	Retry_every int64             // Retry interval at which to retry after Check failure (in secons)
-	Timeout     int64             // Maximum execution time for the Check (in seconds)
-	Env         map[string]string // Map of environment variables to set during Check execution
-	Run_as      string            // User name to run this Check as
-	Bulk        string            // Is this check a bulk-mode check
-	Report      string            // Should this check report its exit code as a STATE event? (bulk-mode only)
-	Name        string            // Name of the Check
-
-	cmd_args []string
-	process  *exec.Cmd
-	rc       int
-	attempts int
-	stdout   *bytes.Buffer
-	stderr   *bytes.Buffer
-	output   string
-	err_msg  string
+	Command            string            // Command to execute for this Check
+	Builtin            string            // Name of a builtin check to run instead of a Command (disk, load, memory, process, or file)
+	Plugin             string            // Name of a plugin to run this Check via, instead of a Command
+	Params             map[string]string // Parameters for the builtin check (thresholds, paths, etc.), or to pass to the plugin
+	Every              int64             // Specific interval at which to run this Check (in seconds)
+	Retries            int               // Number of times to retry this Check after failure
+	Retry_every        int64             // Retry interval at which to retry after Check failure (in secons)
+	Timeout            int64             // Maximum execution time for the Check (in seconds)
+	Env                map[string]string // Map of environment variables to set during Check execution
+	Run_as             string            // User name to run this Check as
+	Run_as_group       string            // Group name (or gid) to run this Check as
+	Bulk               Toggle            // Is this check a bulk-mode check
+	Report             Toggle            // Should this check report its exit code as a STATE event? (bulk-mode only)
+	Exit_state         Toggle            // Should this check report its exit code as a STATE event, with the first line of its output as the message? (non-bulk only)
+	Name               string            // Name of the Check
+	Use                string            // Name of a template to inherit unset directives from
+	Foreach            []string          // List of values to generate one Check per value from
+	Glob               string            // Glob pattern to generate one Check per matching path from
+	Cwd                string            // Working directory to run the Check from (defaults to /)
+	Umask              string            // Umask (in octal) to run the Check with (defaults to bmad's umask)
+	Stdin              string            // Data to provide on the Check's stdin, or 'file:/path' to read it from a file
+	Limits             Limits            // Resource limits to apply to the Check's process
+	Cgroup             Cgroup            // cgroup (v2) to run the Check in, along with its limits
+	Timeout_signal     string            // Signal to send the Check when it exceeds its Timeout (defaults to SIGTERM)
+	Kill_after         *int64            // Time to wait after sending Timeout_signal before sending SIGKILL (in seconds, defaults to 2)
+	Report_timeout     Toggle            // Send a STATE for the Check as soon as it times out, rather than after it's reaped
+	Allow_long_timeout Toggle            // Allow Timeout to exceed Retry_every
+	Max_output         int64             // Maximum amount of standard output to capture from the Check (in bytes, 0 for no limit)
+	Max_stderr         int64             // Maximum amount of standard error to capture from the Check (in bytes, 0 for no limit)
+	Stream             Toggle            // Send each line of output to bolo as soon as the Check writes it (bulk-mode only)
+	Mode               string            // How the Check is run: scheduled (every Every seconds), or persistent (continuously, restarting it when it exits)
+	Exit_codes         map[string]string // Map of the Check's exit codes to the states (OK, WARNING, CRITICAL, UNKNOWN) they represent
+	Signal_rc          string            // State to report when the Check is killed by a signal (defaults to UNKNOWN)
+
+	cmd_args      []string
+	secrets       []string
+	file_defaults *Check
+	sources       []string
+	item          *string // value the Check was generated with, via foreach or glob, until initialize_check substitutes it
+
+	process   *exec.Cmd
+	builtin   chan builtin_result // results of the current run of a builtin or plugin check
+	rc        int
+	attempts  int
+	stdout    *capture
+	stderr    *capture
+	output    string
+	err_msg   string
+	truncated bool // was the output of the last run cut short by Max_output or Max_stderr?
 
 	started_at time.Time
 	ended_at   time.Time
@@ -53,8 +84,23 @@ type Check struct {
 	duration   time.Duration
 	running    bool
 
-	sig_term bool
-	sig_kill bool
+	sig_term  bool
+	sig_kill  bool
+	orphans   int            // processes left behind by the last run of the check (or -1 if unknown)
+	exit_code int            // raw exit code of the last run of the check (or -1 if it was killed by a signal)
+	signal    syscall.Signal // signal that killed the last run of the check (if any)
+
+	backoff     int64     // current delay before restarting a persistent check (in seconds)
+	reported_at time.Time // last time the uptime of a persistent check was reported
+	stopping    bool      // has a persistent check been asked to stop?
+	stopped_at  time.Time // when a persistent check was asked to stop
+
+	cgroup      string        // cgroup the current run of the check was placed in
+	cgroup_skip bool          // cgroups couldn't be used, don't bother trying again
+	cpu_base    time.Duration // cpu usage of the cgroup before the current run started
+	cpu_time    time.Duration // cpu used by the last run of the check
+	memory_peak int64         // peak memory usage of the last run of the check (bytes, or -1 if unknown)
+	accounted   bool          // were cpu_time and memory_peak collected for the last run?
 }
 
 const OK int = 0
@@ -62,6 +108,17 @@ const WARNING int = 1
 const CRITICAL int = 2
 const UNKNOWN int = 3
 
+// Default time to wait between sending a Check its Timeout_signal, and SIGKILL (in seconds)
+const DEFAULT_KILL_AFTER int64 = 2
+
+const MODE_SCHEDULED string = "scheduled"
+const MODE_PERSISTENT string = "persistent"
+
+// Maximum delay before restarting a persistent Check that keeps exiting (in
+// seconds). Persistent Checks that stay up for longer than this are restarted
+// right away, the next time they exit.
+const MAX_BACKOFF int64 = 300
+
 // Converts the Check's environment variable map
 // into an array of bash-compatibally formated environment
 // variables.
@@ -87,10 +144,24 @@ func merge_checks(check *Check, old *Check) {
 	check.stderr = old.stderr
 	check.output = old.output
 	check.err_msg = old.err_msg
+	check.truncated = old.truncated
 	check.sig_term = old.sig_term
 	check.sig_kill = old.sig_kill
+	check.orphans = old.orphans
+	check.exit_code = old.exit_code
+	check.signal = old.signal
+	check.backoff = old.backoff
+	check.reported_at = old.reported_at
+	check.stopping = old.stopping
+	check.stopped_at = old.stopped_at
 	check.process = old.process
+	check.builtin = old.builtin
 	check.running = old.running
+	check.cgroup = old.cgroup
+	check.cpu_base = old.cpu_base
+	check.cpu_time = old.cpu_time
+	check.memory_peak = old.memory_peak
+	check.accounted = old.accounted
 }
 
 // Schedules the next run of the Check. If interval is
@@ -107,17 +178,16 @@ func (self *Check) schedule(last_started time.Time, interval int64) {
 // up buffers for grabbing check output, run the process,
 // and fill out accounting data for the check.
 func (self *Check) Spawn() error {
+	if self.Builtin != "" {
+		return self.spawn_builtin()
+	}
+	if self.Plugin != "" {
+		return self.spawn_plugin()
+	}
 	if self.running {
 		return errors.New(fmt.Sprintf("check %s[%d] is already running", self.Name, self.process.Process.Pid))
 	}
 
-	process := exec.Command(self.cmd_args[0], self.cmd_args[1:]...)
-	process.Env = self.environment()
-	process.Dir = "/"
-	var o bytes.Buffer
-	var e bytes.Buffer
-	process.Stdout = &o
-	process.Stderr = &e
 	self.output = ""
 	self.err_msg = ""
 
@@ -127,42 +197,290 @@ func (self *Check) Spawn() error {
 	// long-term fixes (user creation, file creation/renames/permissions)
 	self.started_at = time.Now()
 
-	if self.Run_as != "" {
-		u, err := user.Lookup(self.Run_as)
-		if err != nil {
-			return err
+	process, err := self.command()
+	if err != nil {
+		return err
+	}
+
+	self.cgroup = ""
+	self.accounted = false
+	if self.Cgroup.Root != "" && !self.cgroup_skip {
+		cgroup, err := setup_cgroup(self.Cgroup, self.Name)
+		if err == nil {
+			self.cpu_base, _, _ = cgroup_usage(cgroup)
+			err = attach_cgroup(process, cgroup)
 		}
-		uid, err := strconv.ParseUint(u.Uid, 10, 32)
 		if err != nil {
-			return err
+			log.Warnf("Couldn't set up cgroup for check %s, running it without cgroups: %s", self.Name, err.Error())
+			self.cgroup_skip = true
+		} else {
+			self.cgroup = cgroup
 		}
-		gid, err := strconv.ParseUint(u.Gid, 10, 32)
-		if err != nil {
-			return err
+	}
+
+	stdout, stderr, err := self.start(process)
+	if err != nil && self.cgroup != "" {
+		// the kernel may not support spawning directly into a cgroup,
+		// so see if the check can be run without it
+		retry, retry_err := self.command()
+		if retry_err == nil {
+			stdout, stderr, retry_err = self.start(retry)
 		}
-		log.Debugf("Running check %s as %q", self.Name, self.Run_as)
-		process.SysProcAttr = &syscall.SysProcAttr{
-			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		if retry_err == nil {
+			log.Warnf("Couldn't spawn check %s in cgroup %s, running it without cgroups: %s",
+				self.Name, self.cgroup, err.Error())
+			process, err = retry, nil
+			self.cgroup = ""
+			self.cgroup_skip = true
 		}
 	}
-
-	if err := process.Start(); err != nil {
+	if err != nil {
 		return err
 	}
 	log.Debugf("Spawned check %s[%d]", self.Name, process.Process.Pid)
 
 	self.running = true
 	self.process = process
-	self.stdout = &o
-	self.stderr = &e
+	self.builtin = nil
+	self.stdout = stdout
+	self.stderr = stderr
+	self.truncated = false
 	self.sig_term = false
 	self.sig_kill = false
+	self.stopping = false
+	self.reported_at = self.started_at
 	self.ended_at = time.Time{}
 	self.duration = 0
 
 	return nil
 }
 
+// Kicks off a builtin check in the background, since builtins
+// may block (e.g. checking the disk usage of a hung NFS mount)
+func (self *Check) spawn_builtin() error {
+	if self.running {
+		return errors.New(fmt.Sprintf("check %s is already running", self.Name))
+	}
+	if _, ok := builtins[self.Builtin]; !ok {
+		return errors.New(fmt.Sprintf("Unknown builtin `%s`", self.Builtin))
+	}
+	self.started_at = time.Now()
+
+	// buffered, so that builtins finishing after their timeout don't block
+	results := make(chan builtin_result, 1)
+	go func(host string) {
+		results <- self.run_builtin(host)
+	}(cfg.Host)
+	log.Debugf("Spawned builtin check %s (%s)", self.Name, self.Builtin)
+	self.spawned(results)
+	return nil
+}
+
+// Asks the Check's plugin to run it, launching the plugin if need be
+func (self *Check) spawn_plugin() error {
+	if self.running {
+		return errors.New(fmt.Sprintf("check %s is already running", self.Name))
+	}
+	plugin, ok := cfg.Plugins[self.Plugin]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown plugin `%s`", self.Plugin))
+	}
+	self.started_at = time.Now()
+
+	results, err := plugin.run(self)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Sent check %s to plugin %s", self.Name, self.Plugin)
+	self.spawned(results)
+	return nil
+}
+
+// Resets the state of a builtin or plugin check, which is
+// now running, and will send its results to results
+func (self *Check) spawned(results chan builtin_result) {
+	self.builtin = results
+	self.output = ""
+	self.err_msg = ""
+	self.cgroup = ""
+	self.accounted = false
+	self.truncated = false
+	self.running = true
+	self.sig_term = false
+	self.sig_kill = false
+	self.stopping = false
+	self.ended_at = time.Time{}
+	self.duration = 0
+}
+
+// Checks whether a builtin or plugin check has finished running. Checks
+// that run past their Timeout are abandoned, and reported as UNKNOWN.
+func (self *Check) reap_builtin() bool {
+	var result builtin_result
+	select {
+	case result = <-self.builtin:
+	default:
+		if !time.Now().After(self.started_at.Add(time.Duration(self.Timeout) * time.Second)) {
+			return false
+		}
+		log.Warnf("Check %s has been running too long, abandoning it", self.Name)
+		if plugin, ok := cfg.Plugins[self.Plugin]; ok && self.Plugin != "" {
+			plugin.abandon(self.builtin)
+		}
+		result = builtin_result{rc: UNKNOWN}
+		if self.Builtin != "" {
+			// builtins report their own state
+			result.output = fmt.Sprintf("STATE %d %s:%s %d %s timed out after %ds\n",
+				time.Now().Unix(), cfg.Host, self.Name, UNKNOWN, self.Name, self.Timeout)
+		}
+		self.sig_term = true
+	}
+
+	self.ended_at = time.Now()
+	self.running = false
+	self.duration = time.Since(self.started_at)
+	self.latency = self.started_at.Sub(self.next_run)
+	self.output = result.output
+	self.err_msg = result.err_msg
+	self.exit_code = result.rc
+	self.signal = 0
+	self.orphans = -1
+	self.rc = result.rc
+	if exit_codes, err := parse_exit_codes(self.Exit_codes); err == nil {
+		if rc, ok := exit_codes[self.exit_code]; ok {
+			self.rc = rc
+		}
+	}
+	if self.rc < OK || self.rc > UNKNOWN {
+		self.rc = UNKNOWN
+	}
+	self.reschedule()
+	return true
+}
+
+// Builds the command for running the Check, with its environment,
+// working directory, credentials, stdin, and resource limits
+func (self *Check) command() (*exec.Cmd, error) {
+	process := exec.Command(self.cmd_args[0], self.cmd_args[1:]...)
+	process.Env = self.environment()
+	process.Dir = self.Cwd
+	if process.Dir == "" {
+		process.Dir = "/"
+	}
+	// run checks in their own process group, so that they can be
+	// killed along with anything they spawn
+	process.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if self.Run_as != "" || self.Run_as_group != "" {
+		cred, user_env, err := credentials(self.Run_as, self.Run_as_group)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Running check %s as %q (uid %d, gid %d, groups %v)",
+			self.Name, self.Run_as, cred.Uid, cred.Gid, cred.Groups)
+		process.SysProcAttr.Credential = cred
+		for k, v := range user_env {
+			if _, ok := self.Env[k]; !ok {
+				process.Env = append(process.Env, fmt.Sprintf("%s=%s", k, v))
+			}
+		}
+	}
+
+	if strings.HasPrefix(self.Stdin, "file:") {
+		stdin, err := os.Open(strings.TrimPrefix(self.Stdin, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		process.Stdin = stdin
+	} else if self.Stdin != "" {
+		process.Stdin = strings.NewReader(self.Stdin)
+	}
+
+	settings := shim_settings{Limits: self.Limits}
+	if mask, ok := parse_umask(self.Umask); ok {
+		settings.Umask = &mask
+	}
+	if self.Limits.set() || settings.Umask != nil {
+		// run via bmad, to apply the limits and umask before exec'ing the command
+		encoded, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		exe, err := shim_executable()
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Applying resource limits to check %s: %s", self.Name, string(encoded))
+		process.Args = append([]string{exe, process.Path}, process.Args...)
+		process.Path = exe
+		process.Env = append(process.Env, fmt.Sprintf("%s=%s", LIMITS_ENV, encoded))
+	}
+	return process, nil
+}
+
+// Starts a check's process, capturing its stdout and stderr (up to
+// Max_output and Max_stderr bytes), and closing any files that the child
+// process has its own copies of, once it has been started
+func (self *Check) start(process *exec.Cmd) (*capture, *capture, error) {
+	stdout, stdout_w, err := new_capture(self.Max_output)
+	if err != nil {
+		return nil, nil, err
+	}
+	if self.Stream.On() {
+		stdout.lines = self.stream_line
+	}
+	stderr, stderr_w, err := new_capture(self.Max_stderr)
+	if err != nil {
+		stdout.abandon()
+		stdout_w.Close()
+		return nil, nil, err
+	}
+	if self.Persistent() {
+		// persistent checks may run forever, so log their errors as they go
+		stderr.lines = self.log_stderr
+	}
+	process.Stdout = stdout_w
+	process.Stderr = stderr_w
+
+	err = process.Start()
+	stdout_w.Close()
+	stderr_w.Close()
+	if stdin, ok := process.Stdin.(*os.File); ok {
+		stdin.Close()
+	}
+	release_cgroup(process)
+	if err != nil {
+		stdout.abandon()
+		stderr.abandon()
+		return nil, nil, err
+	}
+	stdout.start()
+	stderr.start()
+	return stdout, stderr, nil
+}
+
+// Sends a line of output from a streaming Check to bolo, as soon as
+// the Check has written it. Lines that aren't valid bolo messages are
+// logged and dropped. Called from the Check's capture goroutine.
+func (self *Check) stream_line(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if err := valid_message(line); err != nil {
+		log.Warnf("Check %s sent an invalid message, not sending it to bolo: %s", self.Name, err.Error())
+		return
+	}
+	if err := SendToBolo(line); err != nil {
+		log.Errorf("Error sending output of check %s to bolo: %s", self.Name, err.Error())
+	}
+}
+
+// Logs a line written to stderr by a persistent Check. Called
+// from the Check's capture goroutine.
+func (self *Check) log_stderr(line string) {
+	log.Warnf("Check %s: %s", self.Name, strings.TrimRight(line, "\n"))
+}
+
 // Called on running checks, to determine if they have finished
 // running.
 //
@@ -170,16 +488,26 @@ func (self *Check) Spawn() error {
 //
 // If the Check has been running for longer than its Timeout,
 // a SIGTERM (and failing that a SIGKILL) is issued to forcibly
-// terminate the rogue Check process. In either case, this returns
+// terminate the rogue Check process, along with any processes it
+// has spawned (via its process group). In either case, this returns
 // as if the check has not yet finished, and Reap() will need to be
 // called again to fully reap the Check
 //
+// Persistent Checks have no Timeout. Instead, their uptime is reported
+// every Every seconds while they're running, and they're only signaled
+// once they have been asked to Stop().
+//
 // If the Check has finished execution (on its own, or via forced
 // termination), it will return true.
 //
 // Once complete, some additional meta-stats for the check execution
 // are appended to the check output, to be submit up to bolo
 func (self *Check) Reap() bool {
+	// dispatch on how the check was spawned, since its config may have
+	// changed while it was running
+	if self.builtin != nil {
+		return self.reap_builtin()
+	}
 	pid := self.process.Process.Pid
 
 	var ws syscall.WaitStatus
@@ -189,22 +517,33 @@ func (self *Check) Reap() bool {
 		return false
 	}
 	if status == 0 {
-		// self to see if we need to sigkill due to failed sigterm
-		if time.Now().After(self.started_at.Add(time.Duration(self.Timeout+2) * time.Second)) {
+		if self.Persistent() {
+			self.supervise(pid)
+			return false
+		}
+		// self to see if we need to send the timeout signal due to self timeout expiry
+		// (only once, since signals like SIGQUIT may have side effects)
+		if !self.sig_kill && !self.sig_term && time.Now().After(self.started_at.Add(time.Duration(self.Timeout)*time.Second)) {
+			sig, _ := parse_signal(self.Timeout_signal)
+			log.Warnf("Check %s[%d] has been running too long, sending %s", self.Name, pid, signal_name(sig))
+			if err := syscall.Kill(-pid, sig); err != nil {
+				log.Errorf("Error sending %s to check %s[%d]: %s", signal_name(sig), self.Name, pid, err.Error())
+			}
+			if self.Report_timeout.On() {
+				self.report_timeout()
+			}
+			self.sig_term = true
+		}
+		kill_after := self.kill_after()
+		// self to see if we need to sigkill due to failed timeout signal
+		// (right away, if kill_after is 0)
+		if self.sig_term && !time.Now().Before(self.started_at.Add(time.Duration(self.Timeout+kill_after)*time.Second)) {
 			log.Warnf("Check %s[%d] has been running too long, sending SIGKILL", self.Name, pid)
-			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+			if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
 				log.Errorf("Error sending SIGKILL to check %s[%d]: %s", self.Name, pid, err.Error())
 			}
 			self.sig_kill = true
 		}
-		// self to see if we need to sigterm due to self timeout expiry
-		if !self.sig_kill && time.Now().After(self.started_at.Add(time.Duration(self.Timeout)*time.Second)) {
-			log.Warnf("Check %s[%d] has been running too long, sending SIGTERM", self.Name, pid)
-			if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
-				log.Errorf("Error sending SIGTERM to check %s[%d]: %s", self.Name, pid, err.Error())
-			}
-			self.sig_term = true
-		}
 		return false
 	}
 
@@ -212,14 +551,66 @@ func (self *Check) Reap() bool {
 	self.running = false
 	self.duration = time.Since(self.started_at)
 	self.latency = self.started_at.Sub(self.next_run)
-	self.output = string(self.stdout.Bytes())
-	self.err_msg = string(self.stderr.Bytes())
+	// wait for the output to be drained, before the check's exit is acted on
+	var output_truncated, stderr_truncated bool
+	self.output, output_truncated = self.stdout.finish(CAPTURE_GRACE)
+	self.err_msg, stderr_truncated = self.stderr.finish(CAPTURE_GRACE)
+	self.truncated = output_truncated || stderr_truncated
+	if output_truncated {
+		// drop any partial line, so that it isn't sent to bolo
+		self.output = self.output[:strings.LastIndex(self.output, "\n")+1]
+		if self.Stream.On() {
+			log.Warnf("Check %s[%d] wrote lines longer than %d bytes to stdout, discarding them", self.Name, pid, self.Max_output)
+		} else {
+			log.Warnf("Check %s[%d] wrote more than %d bytes to stdout, discarding the rest", self.Name, pid, self.Max_output)
+		}
+	}
+	if stderr_truncated {
+		log.Warnf("Check %s[%d] wrote more than %d bytes to stderr, discarding the rest", self.Name, pid, self.Max_stderr)
+	}
+
+	// anything left in the check's process group was spawned by the check,
+	// and outlived it. If the check timed out, they're killed as well.
+	self.orphans = -1
+	if orphans, err := process_group(pid); err != nil {
+		log.Debugf("Couldn't look for processes left behind by check %s[%d]: %s", self.Name, pid, err.Error())
+	} else {
+		self.orphans = len(orphans)
+		if len(orphans) > 0 {
+			log.Warnf("Check %s[%d] left %d processes behind: %v", self.Name, pid, len(orphans), orphans)
+			if self.sig_term || self.sig_kill {
+				syscall.Kill(-pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	if self.cgroup != "" {
+		if cpu, memory, err := cgroup_usage(self.cgroup); err != nil {
+			log.Warnf("Couldn't read resource usage of check %s[%d] from %s: %s", self.Name, pid, self.cgroup, err.Error())
+		} else {
+			self.cpu_time = cpu - self.cpu_base
+			self.memory_peak = memory
+			self.accounted = true
+		}
+		// removing the cgroup resets its accounting for the next run (if
+		// any processes are left behind, it will be reused instead)
+		os.Remove(self.cgroup)
+	}
 
 	if ws.Exited() {
-		self.rc = ws.ExitStatus()
+		self.exit_code = ws.ExitStatus()
+		self.signal = 0
+		self.rc = self.exit_code
+		if exit_codes, err := parse_exit_codes(self.Exit_codes); err == nil {
+			if rc, ok := exit_codes[self.exit_code]; ok {
+				self.rc = rc
+			}
+		}
 	} else {
-		log.Debugf("Check %s[%d] exited abnormally (signaled/stopped). Setting rc to UNKNOWN", self.Name, pid)
-		self.rc = UNKNOWN
+		self.exit_code = -1
+		self.signal = ws.Signal()
+		self.rc, _ = parse_state(self.Signal_rc)
+		log.Debugf("Check %s[%d] exited abnormally (%s). Setting rc to %d", self.Name, pid, signal_name(self.signal), self.rc)
 	}
 	if self.rc > UNKNOWN {
 		log.Debugf("Check %s[%d] returned with an invalid exit code. Setting rc to UNKOWN", self.Name, pid)
@@ -241,8 +632,8 @@ func (self *Check) Reap() bool {
 
 // Submits check results to bolo. This will append meta-stats
 // to the checks as well, for bmad (like checks run, execution
-// time, check latency). If the check has Bulk and Report both set
-// to "true", it will report a STATE for the bulk check's execution.
+// time, check latency). If the check has Bulk and Report both
+// enabled, it will report a STATE for the bulk check's execution.
 // If the bulk check failed, any output to stderr will be included
 // in the status message.
 //
@@ -253,12 +644,25 @@ func (self *Check) Submit(full_stats bool) error {
 	// Add meta-stats for bmad
 	var meta string
 	var msg string
-	if self.Bulk == "true" && self.Report == "true" {
+	if !self.Bulk.On() && self.Exit_state.On() && self.Builtin == "" && self.final() {
+		// check-specific state (for non-bulk checks, once retries are exhausted;
+		// builtins already report their own state)
+		msg = strings.SplitN(self.output, "\n", 2)[0]
+		if reason := self.termination(); reason != "" {
+			msg = strings.TrimSpace(fmt.Sprintf("%s %s", reason, msg))
+		}
+		meta = fmt.Sprintf("STATE %d %s:bmad:%s %d %s",
+			time.Now().Unix(), cfg.Host, self.Name, self.rc, msg)
+	}
+	if self.Bulk.On() && self.Report.On() {
 		// check-specific state (for bulk data-submitter checks)
 		if self.rc == OK {
 			msg = self.Name + " completed successfully!"
 		} else {
 			msg = strings.Replace(self.err_msg, "\n", " ", -1)
+			if reason := self.termination(); reason != "" {
+				msg = strings.TrimSpace(fmt.Sprintf("%s %s", reason, msg))
+			}
 		}
 		meta = fmt.Sprintf("STATE %d %s:bmad:%s %d %s",
 			time.Now().Unix(), cfg.Host, self.Name, self.rc, msg)
@@ -266,6 +670,44 @@ func (self *Check) Submit(full_stats bool) error {
 	// check-specific runtime
 	meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:exec-time %0.4f",
 		meta, time.Now().Unix(), cfg.Host, self.Name, self.duration.Seconds())
+	if self.timed_out() {
+		// check was signaled by bmad for running too long
+		meta = fmt.Sprintf("%s\nCOUNTER %d %s:bmad:%s:timeouts",
+			meta, time.Now().Unix(), cfg.Host, self.Name)
+	}
+	if self.Persistent() && !self.stopping {
+		// persistent check exited on its own, and is being restarted
+		meta = fmt.Sprintf("%s\nCOUNTER %d %s:bmad:%s:restarts",
+			meta, time.Now().Unix(), cfg.Host, self.Name)
+	}
+	if self.signal != 0 {
+		// signal that killed the check
+		meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:signal %d",
+			meta, time.Now().Unix(), cfg.Host, self.Name, int(self.signal))
+	} else {
+		// raw exit code of the check
+		meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:exit-code %d",
+			meta, time.Now().Unix(), cfg.Host, self.Name, self.exit_code)
+	}
+	if self.orphans >= 0 {
+		// processes left running by the check
+		meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:orphans %d",
+			meta, time.Now().Unix(), cfg.Host, self.Name, self.orphans)
+	}
+	if self.accounted {
+		// check-specific resource usage (from its cgroup)
+		meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:cpu-time %0.4f",
+			meta, time.Now().Unix(), cfg.Host, self.Name, self.cpu_time.Seconds())
+		if self.memory_peak >= 0 {
+			meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:%s:memory-peak %d",
+				meta, time.Now().Unix(), cfg.Host, self.Name, self.memory_peak)
+		}
+	}
+	if self.truncated {
+		// output discarded due to max_output/max_stderr
+		meta = fmt.Sprintf("%s\nCOUNTER %d %s:bmad:%s:output-truncated",
+			meta, time.Now().Unix(), cfg.Host, self.Name)
+	}
 	// bmad avg check runtime
 	meta = fmt.Sprintf("%s\nSAMPLE %d %s:bmad:exec-time %0.4f",
 		meta, time.Now().Unix(), cfg.Host, self.duration.Seconds())
@@ -281,9 +723,18 @@ func (self *Check) Submit(full_stats bool) error {
 
 	meta = meta + "\n"
 	log.Debugf("%s output: %s", self.Name, self.output)
+	output := self.output
+	if self.Stream.On() && strings.TrimSpace(output) != "" {
+		// the unterminated last line of a streaming check's output
+		// wasn't streamed, so it still needs validating
+		if err := valid_message(output); err != nil {
+			log.Warnf("Check %s sent an invalid message, not sending it to bolo: %s", self.Name, err.Error())
+			output = ""
+		}
+	}
 	var err error
-	if self.Bulk == "true" || self.attempts >= self.Retries {
-		err = SendToBolo(fmt.Sprintf("%s\n%s", self.output, meta))
+	if self.final() {
+		err = SendToBolo(fmt.Sprintf("%s\n%s", output, meta))
 	} else {
 		log.Debugf("%s not yet at max attempts, suppressing output submission", self.Name)
 		err = SendToBolo(meta)
@@ -299,8 +750,8 @@ func (self *Check) Fail(failure error) error {
 	var err error
 	self.rc = 3
 	self.reschedule()
-	if self.Report == "true" {
-		if self.Bulk == "true" || self.attempts >= self.Retries {
+	if self.Report.On() || self.Exit_state.On() {
+		if self.final() {
 			msg := fmt.Sprintf("STATE %d %s:bmad:%s %d %s",
 				time.Now().Unix(), cfg.Host, self.Name, self.rc, "failed to exec: "+failure.Error())
 			err = SendToBolo(msg)
@@ -309,19 +760,290 @@ func (self *Check) Fail(failure error) error {
 	return err
 }
 
+// Function-variables for looking up users and groups (used for mocking during tests)
+var user_current = user.Current
+var user_lookup = user.Lookup
+var user_lookup_group = user.LookupGroup
+var user_lookup_group_id = user.LookupGroupId
+var user_group_ids = func(u *user.User) ([]string, error) {
+	return u.GroupIds()
+}
+
+// Determines the credentials to run a check with, for the given user
+// (defaults to the user running bmad) and group (defaults to the
+// user's primary group). The user's supplementary groups are kept,
+// and HOME, USER and LOGNAME are returned as environment variables
+// to set for the check, to match the user.
+func credentials(run_as string, run_as_group string) (*syscall.Credential, map[string]string, error) {
+	var u *user.User
+	var err error
+	if run_as != "" {
+		u, err = user_lookup(run_as)
+	} else {
+		u, err = user_current()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gid_str := u.Gid
+	if run_as_group != "" {
+		g, err := user_lookup_group(run_as_group)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			if by_id, id_err := user_lookup_group_id(run_as_group); id_err == nil {
+				g, err = by_id, nil
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		gid_str = g.Gid
+	}
+	gid, err := strconv.ParseUint(gid_str, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	group_ids, err := user_group_ids(u)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Unable to look up groups for user %s: %s", u.Username, err.Error()))
+	}
+	var groups []uint32
+	for _, id := range group_ids {
+		group, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		groups = append(groups, uint32(group))
+	}
+
+	env := map[string]string{
+		"HOME":    u.HomeDir,
+		"USER":    u.Username,
+		"LOGNAME": u.Username,
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, env, nil
+}
+
+// Signals that can be sent to checks that time out
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// Parses a signal name (e.g. SIGTERM, or just TERM, in any case), defaulting
+// to SIGTERM if name is empty. Returns false if the signal is unknown.
+func parse_signal(name string) (syscall.Signal, bool) {
+	if name == "" {
+		return syscall.SIGTERM, true
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return syscall.SIGTERM, false
+	}
+	return sig, true
+}
+
+// Returns the name of a signal (e.g. SIGTERM)
+func signal_name(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// Parses a state (OK, WARNING, CRITICAL, or UNKNOWN, or their numeric
+// values), returning false if it isn't valid. The empty string is UNKNOWN.
+func parse_state(state string) (int, bool) {
+	switch strings.ToUpper(state) {
+	case "OK", "0":
+		return OK, true
+	case "WARNING", "1":
+		return WARNING, true
+	case "CRITICAL", "2":
+		return CRITICAL, true
+	case "UNKNOWN", "3", "":
+		return UNKNOWN, true
+	}
+	return UNKNOWN, false
+}
+
+// Parses the exit_codes of a Check into a map of exit codes to states
+func parse_exit_codes(exit_codes map[string]string) (map[int]int, error) {
+	parsed := map[int]int{}
+	for code, state := range exit_codes {
+		c, err := strconv.Atoi(code)
+		if err != nil || c < 0 || c > 255 {
+			return nil, errors.New(fmt.Sprintf("Invalid exit code `%s` in exit_codes, expected a number between 0 and 255", code))
+		}
+		rc, ok := parse_state(state)
+		if !ok || state == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid state `%s` for exit code %d, expected OK, WARNING, CRITICAL, or UNKNOWN", state, c))
+		}
+		parsed[c] = rc
+	}
+	return parsed, nil
+}
+
+// Parses an octal umask value, returning false if the
+// umask is unset or invalid
+func parse_umask(umask string) (int, bool) {
+	if umask == "" {
+		return 0, false
+	}
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, false
+	}
+	return int(mask), true
+}
+
+// Sends a STATE for a Check that has just timed out, so that bolo
+// finds out right away, rather than once the Check is finally reaped
+func (self *Check) report_timeout() {
+	msg := fmt.Sprintf("STATE %d %s:bmad:%s %d %s timed out after %ds\n",
+		time.Now().Unix(), cfg.Host, self.Name, UNKNOWN, self.Name, self.Timeout)
+	if err := SendToBolo(msg); err != nil {
+		log.Errorf("Error submitting timeout state for %s: %s", self.Name, err.Error())
+	}
+}
+
+// Returns the time to wait between sending a Check its Timeout_signal, and SIGKILL
+func (self *Check) kill_after() int64 {
+	if self.Kill_after == nil {
+		return DEFAULT_KILL_AFTER
+	}
+	return *self.Kill_after
+}
+
+// Returns true if the results of the last run of the Check should be
+// submitted: bulk checks always are, while non-bulk checks are only
+// submitted once they have used up their retries (or, for checks with
+// exit_state enabled, once they succeed, so that their OK state is sent)
+func (self *Check) final() bool {
+	return self.Bulk.On() || (self.Exit_state.On() && self.rc == OK) || self.attempts >= self.Retries
+}
+
+// Returns true if the last run of the Check was signaled by bmad
+// for exceeding its Timeout
+func (self *Check) timed_out() bool {
+	return (self.sig_term || self.sig_kill) && !self.stopping
+}
+
+// Describes how the last run of the Check was terminated: whether it timed
+// out, was stopped by bmad, and/or was killed by a signal (from bmad, or
+// elsewhere). Returns "" if the Check exited normally.
+func (self *Check) termination() string {
+	var reasons []string
+	if self.timed_out() {
+		reasons = append(reasons, fmt.Sprintf("timed out after %ds", self.Timeout))
+	} else if self.stopping {
+		reasons = append(reasons, "stopped by bmad")
+	}
+	if self.signal != 0 {
+		reasons = append(reasons, "killed by "+signal_name(self.signal))
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(reasons, ", ") + ")"
+}
+
+// Returns true if the Check runs continuously, rather than on a schedule
+func (self *Check) Persistent() bool {
+	return self.Mode == MODE_PERSISTENT
+}
+
+// Keeps tabs on a running persistent Check, reporting its uptime every
+// Every seconds, and sending SIGKILL if it hasn't exited Kill_after
+// seconds after being asked to Stop()
+func (self *Check) supervise(pid int) {
+	if self.stopping && !self.sig_kill &&
+		time.Now().After(self.stopped_at.Add(time.Duration(self.kill_after())*time.Second)) {
+		log.Warnf("Check %s[%d] hasn't stopped, sending SIGKILL", self.Name, pid)
+		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+			log.Errorf("Error sending SIGKILL to check %s[%d]: %s", self.Name, pid, err.Error())
+		}
+		self.sig_kill = true
+	}
+	if time.Since(self.reported_at) >= time.Duration(self.Every)*time.Second {
+		self.reported_at = time.Now()
+		msg := fmt.Sprintf("SAMPLE %d %s:bmad:%s:uptime %0.4f\n",
+			time.Now().Unix(), cfg.Host, self.Name, time.Since(self.started_at).Seconds())
+		if err := SendToBolo(msg); err != nil {
+			log.Errorf("Error submitting uptime for %s: %s", self.Name, err.Error())
+		}
+	}
+}
+
+// Stops a running persistent Check (when bmad is shutting down, or the Check
+// has been removed or changed), by sending it its Timeout_signal, followed by
+// SIGKILL Kill_after seconds later. Reap() still needs to be called until the
+// Check exits. Once reaped, the Check is scheduled to start again right away.
+func (self *Check) Stop() {
+	if !self.running || self.stopping {
+		return
+	}
+	pid := self.process.Process.Pid
+	sig, _ := parse_signal(self.Timeout_signal)
+	log.Infof("Stopping check %s[%d] with %s", self.Name, pid, signal_name(sig))
+	if err := syscall.Kill(-pid, sig); err != nil {
+		log.Errorf("Error sending %s to check %s[%d]: %s", signal_name(sig), self.Name, pid, err.Error())
+	}
+	self.stopping = true
+	self.stopped_at = time.Now()
+	self.sig_term = true
+}
+
 // Determines whether or not a Check should be run
 func (self *Check) ShouldRun() bool {
 	return !self.running && time.Now().After(self.next_run)
 }
 
+// Returns the config file(s) the Check was defined in
+func (self *Check) Sources() []string {
+	return self.sources
+}
+
 // Returns the last output of a check
 func (self *Check) Output() string {
 	return self.output
 }
 
 func (self *Check) reschedule() {
+	if self.Persistent() {
+		// restart persistent checks, backing off if they keep exiting
+		switch {
+		case self.stopping || time.Since(self.started_at) > time.Duration(MAX_BACKOFF)*time.Second:
+			self.backoff = 0
+		case self.backoff == 0:
+			self.backoff = 1
+		case self.backoff*2 > MAX_BACKOFF:
+			self.backoff = MAX_BACKOFF
+		default:
+			self.backoff *= 2
+		}
+		self.next_run = time.Now().Add(time.Duration(self.backoff) * time.Second)
+		return
+	}
 	self.schedule(self.started_at, self.Every)
-	if self.Bulk != "true" {
+	if !self.Bulk.On() {
 		if self.rc != OK {
 			self.attempts++
 			if self.attempts < self.Retries {
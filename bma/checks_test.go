@@ -2,7 +2,6 @@ package bma
 
 import "testing"
 import "github.com/stretchr/testify/assert"
-import "bytes"
 import "errors"
 import "fmt"
 import "os"
@@ -10,6 +9,7 @@ import "os/exec"
 import "os/user"
 import "regexp"
 import "strings"
+import "syscall"
 import "time"
 
 
@@ -30,12 +30,22 @@ func Test_merge_checks(t *testing.T) {
 		attempts:      2,
 		rc:            2,
 		latency:       1345,
-		stdout:        &bytes.Buffer{},
-		stderr:        &bytes.Buffer{},
+		stdout:        &capture{},
+		stderr:        &capture{},
+		truncated:     true,
 		sig_term:      true,
 		sig_kill:      true,
+		backoff:       4,
+		reported_at:   time.Unix(18,0),
+		stopping:      true,
+		stopped_at:    time.Unix(19,0),
 		process:       &exec.Cmd{},
 		running:       true,
+		cgroup:        "/sys/fs/cgroup/bmad/third/third",
+		cpu_base:      time.Duration(5 * time.Second),
+		cpu_time:      time.Duration(2 * time.Second),
+		memory_peak:   4096,
+		accounted:     true,
 	}
 	c := Check{
 		Command:     "echo \"new command\"",
@@ -65,10 +75,20 @@ func Test_merge_checks(t *testing.T) {
 		latency:       1345,
 		stdout:        old.stdout,
 		stderr:        old.stderr,
+		truncated:     true,
 		sig_term:      true,
 		sig_kill:      true,
+		backoff:       4,
+		reported_at:   time.Unix(18,0),
+		stopping:      true,
+		stopped_at:    time.Unix(19,0),
 		process:       old.process,
 		running:       true,
+		cgroup:        "/sys/fs/cgroup/bmad/third/third",
+		cpu_base:      time.Duration(5 * time.Second),
+		cpu_time:      time.Duration(2 * time.Second),
+		memory_peak:   4096,
+		accounted:     true,
 	}
 
 	merge_checks(&c, &old)
@@ -164,6 +184,599 @@ func Test_large_output(t *testing.T) {
 
 	expect_out := strings.Repeat(strings.Repeat(".", 8193) + "done\n", 10)
 	check.test(t, expect_out, 0, "large output succeeds without deadlocking")
+	assert.False(t, check.truncated, "output isn't truncated without max_output")
+}
+
+func Test_output_limits(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	check := Check{
+		cmd_args:   []string{pwd + "/t/bin/test_large_output"},
+		Name:       "test_large_output",
+		Every:      300,
+		Timeout:    20,
+		Max_output: 20000,
+	}
+
+	expect_out := strings.Repeat(strings.Repeat(".", 8193) + "done\n", 2)
+	check.test(t, expect_out, 0, "output past max_output is discarded, without deadlocking")
+	assert.True(t, check.truncated, "check is marked as truncated when max_output is hit")
+
+	output := check.test_submission(t, true, 32768)
+	assert.Regexp(t, regexp.MustCompile("\nCOUNTER \\d+ test01.example.com:bmad:test_large_output:output-truncated\n"), output,
+		"truncated checks send an output-truncated COUNTER")
+
+	check.Max_output = 8198
+	check.test(t, strings.Repeat(".", 8193) + "done\n", 0, "output exactly at max_output is kept whole")
+	assert.True(t, check.truncated, "check is marked as truncated when output continues past max_output")
+
+	check.Max_output = 100
+	check.test(t, "", 0, "partial lines are discarded when max_output is hit")
+	assert.True(t, check.truncated, "check is marked as truncated when max_output is hit mid-line")
+
+	check.Max_output = 1000000
+	check.test(t, strings.Repeat(strings.Repeat(".", 8193) + "done\n", 10), 0, "output under max_output is kept")
+	assert.False(t, check.truncated, "check isn't marked as truncated when output is under max_output")
+	check.output = ""
+	output = check.test_submission(t, true, 0)
+	assert.NotContains(t, output, "output-truncated", "untruncated checks don't send an output-truncated COUNTER")
+
+	check = Check{
+		cmd_args:   []string{pwd + "/t/bin/test_large_stderr"},
+		Name:       "test_large_stderr",
+		Every:      300,
+		Timeout:    20,
+		Max_stderr: 1024,
+	}
+	check.test(t, "done\n", 1, "stderr past max_stderr is discarded, without deadlocking")
+	assert.True(t, check.truncated, "check is marked as truncated when max_stderr is hit")
+	assert.Equal(t, 1024, len(check.err_msg), "stderr is captured up to max_stderr")
+}
+
+func Test_stream(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Couldn't create pipe: %s", err.Error())
+	}
+	writer = w
+	defer func () { writer = nil }()
+
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_stream"},
+		Name:     "test_stream",
+		Every:    300,
+		Timeout:  20,
+		Bulk:     TOGGLE_ON,
+		Stream:   TOGGLE_ON,
+	}
+	os.Chmod(check.cmd_args[0], 0755)
+	err = check.Spawn()
+	assert.NoError(t, err, "no errors on successful spawning of check")
+
+	buffer := make([]byte, 1024)
+	r.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	n, err := r.Read(buffer)
+	assert.NoError(t, err, "output is streamed before the check exits")
+	assert.Equal(t, "SAMPLE 1234567890 test.example.com:streamed 42\n", string(buffer[0:n]),
+		"valid lines are streamed as they're written, and invalid lines are dropped")
+	assert.False(t, check.Reap(), "check is still running")
+
+	var finished bool
+	for i := 0; i < 50 && !finished; i++ {
+		time.Sleep(100 * time.Millisecond)
+		finished = check.Reap()
+	}
+	assert.True(t, finished, "check finished")
+	r.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err = r.Read(buffer)
+	assert.NoError(t, err, "No errors reading output")
+	assert.Equal(t, "COUNTER 1234567890 test.example.com:streamed\n", string(buffer[0:n]),
+		"later lines are streamed too")
+	assert.Equal(t, "SAMPLE 1234567890 test.example.com:partial 1", check.output,
+		"unterminated lines are left to be submitted with the meta-stats")
+	err = check.Submit(false)
+	assert.NoError(t, err, "no errors submitting the check")
+	output := read_bolo(r, 100 * time.Millisecond)
+	assert.Contains(t, output, "SAMPLE 1234567890 test.example.com:partial 1\n", "valid unterminated lines are submitted")
+
+	check.output = "this is not a bolo message"
+	err = check.Submit(false)
+	assert.NoError(t, err, "no errors submitting the check")
+	output = read_bolo(r, 100 * time.Millisecond)
+	assert.NotContains(t, output, "this is not a bolo message", "invalid unterminated lines are dropped")
+	assert.Contains(t, output, "test_stream:exec-time", "meta-stats are still submitted")
+
+	check.Max_output = 40
+	check.output = ""
+	err = check.Spawn()
+	assert.NoError(t, err, "no errors on successful spawning of check")
+	for finished = false; !finished; finished = check.Reap() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err = r.Read(buffer)
+	assert.Error(t, err, "lines longer than max_output aren't streamed")
+	assert.True(t, check.truncated, "check is marked as truncated when a line is longer than max_output")
+}
+
+// Reads whatever is sent to bolo within the given duration
+func read_bolo(r *os.File, d time.Duration) string {
+	var output string
+	buffer := make([]byte, 4096)
+	r.SetReadDeadline(time.Now().Add(d))
+	for {
+		n, err := r.Read(buffer)
+		output += string(buffer[0:n])
+		if err != nil {
+			return output
+		}
+	}
+}
+
+func Test_persistent(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Couldn't create pipe: %s", err.Error())
+	}
+	writer = w
+	defer func () { writer = nil }()
+
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_persistent"},
+		Name:     "test_persistent",
+		Every:    1,
+		Timeout:  1,
+		Bulk:     TOGGLE_ON,
+		Stream:   TOGGLE_ON,
+		Mode:     MODE_PERSISTENT,
+	}
+	os.Chmod(check.cmd_args[0], 0755)
+	err = check.Spawn()
+	assert.NoError(t, err, "no errors on successful spawning of check")
+
+	for i := 0; i < 25; i++ {
+		assert.False(t, check.Reap(), "persistent check keeps running")
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.False(t, check.sig_term, "persistent checks aren't sent their timeout signal")
+	assert.False(t, check.sig_kill, "persistent checks aren't sigkilled")
+	output := read_bolo(r, 100 * time.Millisecond)
+	assert.Contains(t, output, "SAMPLE 1234567890 test.example.com:persistent 1\n", "persistent check output is streamed")
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_persistent:uptime [12]\\.\\d+\n"), output,
+		"persistent check uptime is reported every interval")
+
+	check.Stop()
+	var finished bool
+	for i := 0; i < 50 && !finished; i++ {
+		time.Sleep(100 * time.Millisecond)
+		finished = check.Reap()
+	}
+	assert.True(t, finished, "persistent check exits when stopped")
+	assert.Equal(t, 0, check.rc, "persistent check was sent its timeout signal")
+	assert.WithinDuration(t, time.Now(), check.next_run, 1 * time.Second, "stopped persistent checks are restarted right away")
+	output = check.test_submission(t, true, 0)
+	assert.NotContains(t, output, "restarts", "stopped persistent checks don't count as restarts")
+
+	check.cmd_args = []string{pwd + "/t/bin/test_persistent", "exit"}
+	check.Report = TOGGLE_ON
+	for _, backoff := range []int64{1, 2, 4} {
+		err = check.Spawn()
+		assert.NoError(t, err, "no errors on successful spawning of check")
+		for finished = false; !finished; finished = check.Reap() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, backoff, check.backoff, "restart delay doubles each time a persistent check exits")
+		assert.WithinDuration(t, time.Now().Add(time.Duration(backoff) * time.Second), check.next_run, 1 * time.Second,
+			"persistent checks that exit are restarted after the delay")
+	}
+	read_bolo(r, 100 * time.Millisecond) // discard the streamed output
+	output = check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("COUNTER \\d+ test01.example.com:bmad:test_persistent:restarts\n"), output,
+		"persistent check restarts are counted")
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_persistent 1 "), output,
+		"persistent check exits are reported")
+
+	check.backoff = MAX_BACKOFF
+	check.reschedule()
+	assert.Equal(t, MAX_BACKOFF, check.backoff, "restart delay is limited to MAX_BACKOFF")
+	check.started_at = time.Now().Add(-1 * time.Hour)
+	check.reschedule()
+	assert.Equal(t, int64(0), check.backoff, "persistent checks that stayed up are restarted right away")
+}
+
+func Test_exit_codes(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	whoami, err := user.Current()
+	if err != nil {
+		t.Fatalf("Couldn't find current user. Bailing out: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	expect_out := "VAR1 \nRunning as '" + whoami.Username + "'\n"
+
+	check := Check{
+		cmd_args:   []string{pwd + "/t/bin/test_check", "4"},
+		Name:       "test_exit_codes",
+		Every:      300,
+		Timeout:    20,
+		Exit_codes: map[string]string{"0": "CRITICAL", "4": "WARNING", "255": "2"},
+	}
+	check.test(t, expect_out, WARNING, "exit codes are mapped via exit_codes")
+	assert.Equal(t, 4, check.exit_code, "raw exit code is kept")
+	output := check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_exit_codes:exit-code 4\n"), output,
+		"raw exit code is sent to bolo")
+
+	check.cmd_args = []string{pwd + "/t/bin/test_check", "0"}
+	check.test(t, expect_out, CRITICAL, "mapped exit codes can be worse than they look")
+
+	check.cmd_args = []string{pwd + "/t/bin/test_check", "5"}
+	check.test(t, expect_out, UNKNOWN, "unmapped exit codes above 3 are still UNKNOWN")
+	assert.Equal(t, 5, check.exit_code, "raw exit code is kept")
+
+	kill_after := int64(1)
+	check = Check{
+		cmd_args:   []string{pwd + "/t/bin/test_timeout"},
+		Name:       "test_exit_codes",
+		Every:      300,
+		Timeout:    1,
+		Kill_after: &kill_after,
+		Signal_rc:  "CRITICAL",
+	}
+	check.test(t, "caught TERM\n", CRITICAL, "signal_rc is used when the check is killed by a signal")
+	assert.Equal(t, -1, check.exit_code, "checks killed by a signal have no exit code")
+	assert.Equal(t, syscall.SIGKILL, check.signal, "signal that killed the check is kept")
+	output = check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_exit_codes:signal 9\n"), output,
+		"signal that killed the check is sent to bolo")
+	assert.NotContains(t, output, "exit-code", "no exit code is sent for checks killed by a signal")
+
+	check.Signal_rc = ""
+	check.test(t, "caught TERM\n", UNKNOWN, "checks killed by a signal are UNKNOWN by default")
+}
+
+func Test_parse_state(t *testing.T) {
+	for state, rc := range map[string]int{
+		"OK": OK, "warning": WARNING, "Critical": CRITICAL, "UNKNOWN": UNKNOWN,
+		"0": OK, "1": WARNING, "2": CRITICAL, "3": UNKNOWN, "": UNKNOWN,
+	} {
+		got, ok := parse_state(state)
+		assert.True(t, ok, "%q is a valid state", state)
+		assert.Equal(t, rc, got, "%q is parsed as %d", state, rc)
+	}
+	for _, state := range []string{"4", "-1", "FINE", "WARN"} {
+		_, ok := parse_state(state)
+		assert.False(t, ok, "%q is not a valid state", state)
+	}
+}
+
+func Test_process_settings(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_process"},
+		Name:     "test_process",
+		Every:    300,
+		Timeout:  20,
+	}
+
+	mask := syscall.Umask(022)
+	defer syscall.Umask(mask)
+	check.test(t, "cwd /\numask 0022\nstdin \n", 0, "default process settings")
+
+	check.Cwd   = pwd + "/t"
+	check.Umask = "077"
+	check.Stdin = "hello from bmad"
+	check.test(t, fmt.Sprintf("cwd %s/t\numask 0077\nstdin hello from bmad\n", pwd), 0, "custom process settings")
+	assert.Equal(t, 022, syscall.Umask(022), "bmad's umask is unaffected by spawning a check")
+
+	check.Stdin = "file:" + pwd + "/t/data/stdin.txt"
+	check.test(t, fmt.Sprintf("cwd %s/t\numask 0077\nstdin from a file\n", pwd), 0, "stdin from a file")
+
+	check.Stdin = "file:" + pwd + "/t/data/nonexistent.txt"
+	err = check.Spawn()
+	assert.EqualError(t, err, "open " + pwd + "/t/data/nonexistent.txt: no such file or directory",
+		"check.Spawn() fails if the stdin file can't be opened")
+	assert.False(t, check.running, "check isn't running after failing to spawn")
+}
+
+func Test_parse_umask(t *testing.T) {
+	mask, ok := parse_umask("022")
+	assert.True(t, ok, "022 is a valid umask")
+	assert.Equal(t, 022, mask, "umasks are octal")
+	mask, ok = parse_umask("0")
+	assert.True(t, ok, "0 is a valid umask")
+	assert.Equal(t, 0, mask, "umasks are octal")
+	_, ok = parse_umask("")
+	assert.False(t, ok, "empty umasks are unset")
+	_, ok = parse_umask("089")
+	assert.False(t, ok, "umasks must be octal")
+	_, ok = parse_umask("1777")
+	assert.False(t, ok, "umasks are limited to permission bits")
+}
+
+func Test_credentials(t *testing.T) {
+	orig_current  := user_current
+	orig_lookup   := user_lookup
+	orig_group    := user_lookup_group
+	orig_group_id := user_lookup_group_id
+	orig_ids      := user_group_ids
+	defer func () {
+		user_current         = orig_current
+		user_lookup          = orig_lookup
+		user_lookup_group    = orig_group
+		user_lookup_group_id = orig_group_id
+		user_group_ids       = orig_ids
+	}()
+
+	users := map[string]*user.User{
+		"bmad":   &user.User{Uid: "0",    Gid: "0",    Username: "bmad",   HomeDir: "/root"},
+		"bolo":   &user.User{Uid: "1001", Gid: "1001", Username: "bolo",   HomeDir: "/home/bolo"},
+		"broken": &user.User{Uid: "1002", Gid: "1002", Username: "broken", HomeDir: "/home/broken"},
+	}
+	groups := map[string]*user.Group{
+		"adm":    &user.Group{Gid: "4",   Name: "adm"},
+		"docker": &user.Group{Gid: "999", Name: "docker"},
+	}
+	user_current = func () (*user.User, error) { return users["bmad"], nil }
+	user_lookup = func (name string) (*user.User, error) {
+		if u, ok := users[name]; ok {
+			return u, nil
+		}
+		return nil, user.UnknownUserError(name)
+	}
+	user_lookup_group = func (name string) (*user.Group, error) {
+		if g, ok := groups[name]; ok {
+			return g, nil
+		}
+		return nil, user.UnknownGroupError(name)
+	}
+	user_lookup_group_id = func (gid string) (*user.Group, error) {
+		for _, g := range groups {
+			if g.Gid == gid {
+				return g, nil
+			}
+		}
+		return nil, user.UnknownGroupIdError(gid)
+	}
+	user_group_ids = func (u *user.User) ([]string, error) {
+		if u.Username == "broken" {
+			return nil, errors.New("no groups for you")
+		}
+		return []string{u.Gid, "4", "999"}, nil
+	}
+
+	cred, env, err := credentials("bolo", "")
+	assert.NoError(t, err, "credentials() for a user doesn't return an error")
+	assert.Equal(t, &syscall.Credential{Uid: 1001, Gid: 1001, Groups: []uint32{1001, 4, 999}}, cred,
+		"credentials() for a user include its primary and supplementary groups")
+	assert.Equal(t, map[string]string{"HOME": "/home/bolo", "USER": "bolo", "LOGNAME": "bolo"}, env,
+		"credentials() provide environment variables for the user")
+
+	cred, _, err = credentials("bolo", "docker")
+	assert.NoError(t, err, "credentials() for a user and group doesn't return an error")
+	assert.Equal(t, &syscall.Credential{Uid: 1001, Gid: 999, Groups: []uint32{1001, 4, 999}}, cred,
+		"credentials() use the requested group as the primary group")
+
+	cred, env, err = credentials("", "4")
+	assert.NoError(t, err, "credentials() for a gid doesn't return an error")
+	assert.Equal(t, &syscall.Credential{Uid: 0, Gid: 4, Groups: []uint32{0, 4, 999}}, cred,
+		"credentials() for just a group default to the current user")
+	assert.Equal(t, "/root", env["HOME"], "credentials() for just a group use the current user's HOME")
+
+	_, _, err = credentials("nobody-here", "")
+	assert.EqualError(t, err, "user: unknown user nobody-here", "credentials() for unknown users returns an error")
+
+	_, _, err = credentials("bolo", "wheel")
+	assert.EqualError(t, err, "group: unknown group wheel", "credentials() for unknown groups returns an error")
+
+	_, _, err = credentials("broken", "")
+	assert.EqualError(t, err, "Unable to look up groups for user broken: no groups for you",
+		"credentials() returns an error if supplementary groups can't be found")
+}
+
+// Spawns a check that leaves a sleeping child behind, returning the child's pid
+func (check *Check) spawn_orphan(t *testing.T) int {
+	err := check.Spawn()
+	if !assert.NoError(t, err, "No errors spawning check") {
+		t.FailNow()
+	}
+	for i := 0; i < 100 && !check.Reap(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.False(t, check.running, "check finished")
+
+	var child int
+	fmt.Sscanf(check.output, "child %d", &child)
+	if child == 0 {
+		t.Fatalf("Couldn't find child pid in check output: %q", check.output)
+	}
+	return child
+}
+
+// Waits for a process to die (or become a zombie)
+func process_dead(pid int) bool {
+	for i := 0; i < 20; i++ {
+		if p, err := read_proc_stat(pid); err != nil || p.state == "Z" {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_orphans(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_orphans"},
+		Name:     "test_orphans",
+		Every:    300,
+		Timeout:  1,
+	}
+
+	child := check.spawn_orphan(t)
+	defer syscall.Kill(child, syscall.SIGKILL)
+	assert.Equal(t, 1, check.orphans, "children left running are counted as orphans")
+	assert.False(t, process_dead(child), "orphans of checks that didn't time out are left alone")
+	output := check.test_submission(t, false, 1024)
+	assert.Regexp(t, regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:test_orphans:orphans 1"), output,
+		"orphans are reported")
+	syscall.Kill(child, syscall.SIGKILL)
+
+	check.cmd_args = []string{pwd + "/t/bin/test_orphans", "hang"}
+	child = check.spawn_orphan(t)
+	defer syscall.Kill(child, syscall.SIGKILL)
+	assert.True(t, check.sig_term, "check was sigtermed")
+	assert.True(t, process_dead(child), "children of checks that time out are killed too")
+}
+
+func Test_parse_signal(t *testing.T) {
+	for name, expect := range map[string]syscall.Signal{
+		"":        syscall.SIGTERM,
+		"SIGINT":  syscall.SIGINT,
+		"quit":    syscall.SIGQUIT,
+		"SigHup":  syscall.SIGHUP,
+		"sigterm": syscall.SIGTERM,
+	} {
+		sig, ok := parse_signal(name)
+		assert.True(t, ok, "%q is a valid signal", name)
+		assert.Equal(t, expect, sig, "%q is parsed properly", name)
+	}
+	_, ok := parse_signal("SIGWHATEVER")
+	assert.False(t, ok, "unknown signals are invalid")
+
+	assert.Equal(t, "SIGQUIT", signal_name(syscall.SIGQUIT), "signal names are found")
+	assert.Equal(t, "signal 31", signal_name(syscall.Signal(31)), "unnamed signals are numbered")
+}
+
+func Test_timeout_escalation(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Couldn't create pipe: %s", err.Error())
+	}
+	writer = w
+	defer func () { writer = nil }()
+
+	kill_after := int64(1)
+	check := Check{
+		cmd_args:       []string{pwd + "/t/bin/test_timeout"},
+		Name:           "test_timeout",
+		Every:          300,
+		Timeout:        1,
+		Timeout_signal: "SIGINT",
+		Kill_after:     &kill_after,
+		Report_timeout: TOGGLE_ON,
+	}
+	check.test(t, "caught INT\n", 3, "check with custom timeout signal")
+	assert.True(t, check.sig_term, "check was sent its timeout signal")
+	assert.True(t, check.sig_kill, "check was sigkilled")
+	assert.InDelta(t, 2.5 * float64(time.Second), float64(check.duration), 0.6 * float64(time.Second),
+		"check was sigkilled kill_after seconds after its timeout")
+
+	buffer := make([]byte, 1024)
+	n, err := r.Read(buffer)
+	assert.NoError(t, err, "No errors reading output")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:test_timeout 3 test_timeout timed out after 1s\n$"),
+		string(buffer[0:n]), "timeout state is reported as soon as the check times out")
+
+	check.Bulk = TOGGLE_ON
+	check.Report = TOGGLE_ON
+	output := check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_timeout 3 \\(timed out after 1s, killed by SIGKILL\\)\n"),
+		output, "timeout reason is included in the state of bulk checks")
+	assert.Regexp(t, regexp.MustCompile("\nCOUNTER \\d+ test01.example.com:bmad:test_timeout:timeouts\n"), output,
+		"timeouts are counted")
+
+	// whether the check gets to handle its timeout signal is a race, so its output isn't checked
+	kill_after = 0
+	check.Report_timeout = TOGGLE_OFF
+	err = check.Spawn()
+	assert.NoError(t, err, "no errors on successful spawning of check")
+	for finished := false; !finished; finished = check.Reap() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, check.sig_term, "check was sent its timeout signal")
+	assert.True(t, check.sig_kill, "check was sigkilled")
+	assert.InDelta(t, 1.5 * float64(time.Second), float64(check.duration), 0.6 * float64(time.Second),
+		"check was sigkilled right after its timeout, with kill_after 0")
+}
+
+func Test_termination(t *testing.T) {
+	tests := []struct {
+		check  Check
+		expect string
+	}{
+		{Check{},                                                                     ""},
+		{Check{Timeout: 5, sig_term: true},                                           "(timed out after 5s)"},
+		{Check{Timeout: 5, sig_term: true, signal: syscall.SIGTERM},                  "(timed out after 5s, killed by SIGTERM)"},
+		{Check{Timeout: 5, sig_term: true, sig_kill: true, signal: syscall.SIGKILL},  "(timed out after 5s, killed by SIGKILL)"},
+		{Check{signal: syscall.SIGHUP},                                               "(killed by SIGHUP)"},
+		{Check{sig_term: true, stopping: true, signal: syscall.SIGTERM},              "(stopped by bmad, killed by SIGTERM)"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expect, test.check.termination(), "termination() describes how the check was terminated")
+	}
+	assert.True(t,  (&Check{sig_kill: true}).timed_out(),                 "sigkilled checks timed out")
+	assert.False(t, (&Check{signal: syscall.SIGHUP}).timed_out(),        "checks killed by outside signals didn't time out")
+	assert.False(t, (&Check{sig_term: true, stopping: true}).timed_out(), "stopped checks didn't time out")
+
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	check := Check{
+		Name:      "test_check",
+		Bulk:      TOGGLE_ON,
+		Report:    TOGGLE_ON,
+		rc:        UNKNOWN,
+		signal:    syscall.SIGHUP,
+		exit_code: -1,
+		err_msg:   "partial failure\n",
+	}
+	output := check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_check 3 \\(killed by SIGHUP\\) partial failure\n"),
+		output, "outside signals are included in the state of bulk checks, along with stderr")
+	assert.NotContains(t, output, "timeouts", "checks that didn't time out aren't counted")
 }
 
 func Test_check_lifecycle(t *testing.T) {
@@ -286,8 +899,8 @@ func Test_check_lifecycle(t *testing.T) {
 func Test_Submit(t *testing.T) {
 	check := Check{
 		Name:     "test_check",
-		Bulk:     "true",
-		Report:   "true",
+		Bulk:     TOGGLE_ON,
+		Report:   TOGGLE_ON,
 		output:   "myoutput\n",
 		err_msg:  "myerror\nsecondline",
 		rc:       0,
@@ -309,12 +922,12 @@ func Test_Submit(t *testing.T) {
 		"myerror secondline"))
 	assert.Regexp(t, expect, output, "bulk + report with non-ok state gets stderr")
 
-	check.Report = "false"; check.Bulk = "true"
+	check.Report = TOGGLE_OFF; check.Bulk = TOGGLE_ON
 	output = check.test_submission(t, false, 1024)
 	expect = regexp.MustCompile("STATE")
 	assert.NotRegexp(t, expect, output, "bulk + noreport doesn't do state")
 
-	check.Report = "true"; check.Bulk = "false"
+	check.Report = TOGGLE_ON; check.Bulk = TOGGLE_OFF
 	output = check.test_submission(t, false, 1024)
 	assert.NotRegexp(t, expect, output, "nobulk + report doesn't do state")
 
@@ -342,14 +955,14 @@ func Test_Submit(t *testing.T) {
 	expect = regexp.MustCompile("SAMPLE \\d+ test01.example.com:bmad:latency 0.0240")
 	assert.NotRegexp(t, expect, output, "bmad latency meta-stat is not reported")
 
-	check.Bulk     = "true"
+	check.Bulk     = TOGGLE_ON
 	check.attempts = 1
 	check.Retries  = 3
 	output = check.test_submission(t, false, 1024)
 	expect = regexp.MustCompile("^myoutput")
 	assert.Regexp(t, expect, output, "Bulk check with fewer attempts than retries submits status")
 
-	check.Bulk = "false"
+	check.Bulk = TOGGLE_OFF
 	output = check.test_submission(t, false, 1024)
 	expect = regexp.MustCompile("^myoutput")
 	assert.NotRegexp(t, expect, output, "Non-bulk check with fewer attempts than retries doesn't submit status")
@@ -362,6 +975,58 @@ func Test_Submit(t *testing.T) {
 	assert.Regexp(t, expect, output, "Non-bulk check with more attempts than retries submits status")
 }
 
+func Test_exit_state(t *testing.T) {
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	check := Check{
+		Name:       "test_check",
+		Bulk:       TOGGLE_OFF,
+		Exit_state: TOGGLE_ON,
+		Retries:    3,
+		attempts:   1,
+		rc:         CRITICAL,
+		output:     "SAMPLE 1234567890 test01.example.com:free 0\nSAMPLE 1234567890 test01.example.com:used 100\n",
+		err_msg:    "disk full",
+		exit_code:  2,
+	}
+
+	output := check.test_submission(t, false, 1024)
+	assert.NotContains(t, output, "STATE", "exit_state isn't sent until retries are used up")
+
+	check.attempts = 3
+	output = check.test_submission(t, false, 1024)
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_check 2 SAMPLE 1234567890 test01.example.com:free 0\n"),
+		output, "exit_state is sent once retries are used up, with the first line of output")
+	assert.Regexp(t, regexp.MustCompile("^SAMPLE 1234567890 test01.example.com:free 0\n"), output,
+		"check output is still sent")
+
+	check.attempts = 0
+	check.rc       = OK
+	check.output   = "all good\n"
+	output = check.test_submission(t, false, 1024)
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_check 0 all good\n"),
+		output, "exit_state is sent for successful checks")
+
+	check.rc       = UNKNOWN
+	check.attempts = 3
+	check.output   = ""
+	check.Timeout  = 10
+	check.sig_term = true
+	output = check.test_submission(t, false, 1024)
+	assert.Regexp(t, regexp.MustCompile("\nSTATE \\d+ test01.example.com:bmad:test_check 3 \\(timed out after 10s\\)\n"),
+		output, "exit_state includes how the check was terminated")
+
+	check.Exit_state = TOGGLE_OFF
+	output = check.test_submission(t, false, 1024)
+	assert.NotContains(t, output, "STATE", "exit_state isn't sent unless enabled")
+
+	check.Exit_state = TOGGLE_ON
+	output = check.test_failure(t, errors.New("No such file or directory"), 1024)
+	assert.Regexp(t, regexp.MustCompile("STATE \\d+ test01.example.com:bmad:test_check 3 failed to exec: No such file or directory"),
+		output, "exec failures are reported for exit_state checks")
+}
+
 func (check *Check) test_submission(t *testing.T, full_stats bool, buf_len int) (string) {
 	if buf_len == 0 {
 		buf_len = 1024
@@ -381,8 +1046,8 @@ func (check *Check) test_submission(t *testing.T, full_stats bool, buf_len int)
 func Test_Fail(t *testing.T) {
 	check := Check{
 		Name:     "test_check",
-		Bulk:     "true",
-		Report:   "true",
+		Bulk:     TOGGLE_ON,
+		Report:   TOGGLE_ON,
 		rc:       0,
 		duration: time.Duration(42 * time.Second),
 		latency:  time.Duration(24 * time.Millisecond),
@@ -396,7 +1061,7 @@ func Test_Fail(t *testing.T) {
 	assert.Equal(t, 0, check.attempts, "attempts is still set to 0")
 	assert.Equal(t, 3, check.rc, "check is in an unknown state")
 
-	check.Bulk = "false"
+	check.Bulk = TOGGLE_OFF
 	check.Retries = 2
 	check.rc = 0
 	output = check.test_failure(t, mockErr, 1024)
@@ -408,7 +1073,7 @@ func Test_Fail(t *testing.T) {
 	assert.Equal(t, 3, check.rc, "check is in an unknown state")
 	assert.Equal(t, 2, check.attempts, "check attempts incremented again")
 
-	check.Report = "false"
+	check.Report = TOGGLE_OFF
 	check.rc = 0
 	check.attempts = 0
 	check.Retries = 0
@@ -6,12 +6,13 @@ package bma
 import "errors"
 import "fmt"
 import "github.com/starkandwayne/goutils/log"
-import "launchpad.net/goyaml"
 import "io/ioutil"
 import "math/rand"
 import "net"
 import "os"
 import "path/filepath"
+import "reflect"
+import "sort"
 import shellwords "github.com/mattn/go-shellwords"
 import "strings"
 import "time"
@@ -23,18 +24,101 @@ const MIN_INTERVAL int64 = 10
 // Config objects represent the internal bmad configuration,
 // after being loaded from the YAML config file.
 type Config struct {
-	Send_bolo   string            // Command to use for spawning the send_bolo process, to submit Check results
-	Every       int64             // Global default interval to run Checks (in seconds)
-	Retry_every int64             // Global default interval to retry failed Checks (in seconds)
-	Retries     int               // Global default number of times to retry a failed Check
-	Timeout     int64             // Global default timeout for maximum check execution time (in seconds)
-	Bulk        string            // Global default for is this a bulk-mode check
-	Report      string            // Global default for should a bulk check report its STATE
-	Checks      map[string]*Check // Map describing all Checks to be executed via bmad, keyed by Check name
-	Env         map[string]string // Global default environment variables to apply to all Checks run
-	Log         log.LogConfig     // Configuration for the bmad logger
-	Host        string            // Hostname that bmad is running on
-	Include_dir string            // Directory to include *.conf files from
+	Send_bolo    string             // Command to use for spawning the send_bolo process, to submit Check results
+	Every        int64              // Global default interval to run Checks (in seconds)
+	Retry_every  int64              // Global default interval to retry failed Checks (in seconds)
+	Retries      int                // Global default number of times to retry a failed Check
+	Timeout      int64              // Global default timeout for maximum check execution time (in seconds)
+	Bulk         Toggle             // Global default for is this a bulk-mode check
+	Report       Toggle             // Global default for should a bulk check report its STATE
+	Exit_state   Toggle             // Global default for should a non-bulk check report its exit code as a STATE
+	Checks       map[string]*Check  // Map describing all Checks to be executed via bmad, keyed by Check name
+	Templates    map[string]*Check  // Map of Check templates that Checks can inherit from, keyed by template name
+	Plugins      map[string]*Plugin // Map of long-lived plugins that Checks can be run via, keyed by plugin name
+	Env          map[string]string  // Global default environment variables to apply to all Checks run
+	Log          log.LogConfig      // Configuration for the bmad logger
+	Host         string             // Hostname that bmad is running on
+	Include_dir  string             // Directory to include *.conf files from
+	Include      []string           // Additional files, directories, or glob patterns to include check configs from
+	On_duplicate string             // How to handle checks defined in multiple files (first, last, merge, or error)
+	Watch        bool               // Automatically reload the config when config files change?
+	Watch_delay  int64              // Time to wait for changes to config files to settle before reloading (in seconds)
+	Remote       Remote             // HTTP(S) endpoint to fetch additional check configs from
+	Limits       Limits             // Global default resource limits for Check processes
+	Cgroup       Cgroup             // Global default cgroup (v2) settings for Checks
+	Max_output   int64              // Global default maximum standard output to capture from Checks (in bytes, 0 for no limit)
+	Max_stderr   int64              // Global default maximum standard error to capture from Checks (in bytes, 0 for no limit)
+
+	secrets    []string         // Secret values interpolated into Send_bolo, to be masked in logs
+	remote     *remote_document // Copy of the Remote's config document that the checks were loaded from
+	remote_err error            // Why the last good copy of the Remote's config document was used, if it was
+}
+
+// Toggles are tri-state booleans used for check directives that
+// inherit from the global defaults. The zero value means the directive
+// was never set, so that an explicit false can still override a global
+// true. Real YAML booleans are accepted, as well as the string values
+// ("true", "false", "yes", "no", etc.) used by older configs.
+type Toggle int
+
+const TOGGLE_UNSET Toggle = 0
+const TOGGLE_ON Toggle = 1
+const TOGGLE_OFF Toggle = 2
+
+// Marker for values that could not be interpreted as a boolean, so that
+// initialize_check (or parse_config, for the global defaults) can reject
+// them, rather than silently ignoring them.
+const toggle_invalid Toggle = -1
+
+// Returns true if the Toggle has been explicitly enabled
+func (t Toggle) On() bool {
+	return t == TOGGLE_ON
+}
+
+// Implements the goyaml.Setter interface, to parse booleans
+// from either YAML booleans, or their string representations
+func (t *Toggle) SetYAML(tag string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		*t = TOGGLE_UNSET
+	case bool:
+		*t = toggle_from_bool(v)
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "":
+			*t = TOGGLE_UNSET
+		case "true", "yes", "on", "y", "1":
+			*t = TOGGLE_ON
+		case "false", "no", "off", "n", "0":
+			*t = TOGGLE_OFF
+		default:
+			*t = toggle_invalid
+		}
+	case int:
+		*t = toggle_from_bool(v != 0)
+	default:
+		*t = toggle_invalid
+	}
+	return true
+}
+
+// Implements the goyaml.Getter interface, so Toggles are
+// written out as YAML booleans (or omitted, if unset)
+func (t Toggle) GetYAML() (string, interface{}) {
+	switch t {
+	case TOGGLE_ON:
+		return "", true
+	case TOGGLE_OFF:
+		return "", false
+	}
+	return "", nil
+}
+
+func toggle_from_bool(b bool) Toggle {
+	if b {
+		return TOGGLE_ON
+	}
+	return TOGGLE_OFF
 }
 
 // Returns a default config for bmad
@@ -43,12 +127,19 @@ func default_config() *Config {
 	cfg.Every = 300
 	cfg.Retry_every = 60
 	cfg.Checks = map[string]*Check{}
+	cfg.Templates = map[string]*Check{}
+	cfg.Plugins = map[string]*Plugin{}
 	cfg.Retries = 1
 	cfg.Timeout = 45
 	cfg.Send_bolo = "send_bolo -t stream"
 	cfg.Env = map[string]string{}
 	cfg.Host = hostname()
 	cfg.Include_dir = "/etc/bmad.d"
+	cfg.Watch_delay = 2
+	cfg.On_duplicate = "first"
+	cfg.Remote.Every = 300
+	cfg.Remote.Timeout = 10
+	cfg.Remote.Cache = "/var/cache/bmad/remote"
 
 	return &cfg
 }
@@ -105,71 +196,614 @@ func hostname() string {
 
 // Loads a YAML config file specified by cfg_file, and returns
 // a Config object representing that config. Config reloads are
-// auto-detected and handled seemlessly.
+// auto-detected and handled seemlessly. If the config can't be
+// loaded, the current config is returned along with the error.
 func LoadConfig(cfg_file string) (*Config, error) {
+	new_cfg, err := parse_config(cfg_file, false)
+	if err != nil {
+		return cfg, err
+	}
+	activate_config(new_cfg)
+	return cfg, nil
+}
+
+// Transactionally reloads the config from cfg_file. The new config is fully
+// built and validated (any invalid check or include is an error, rather than
+// being skipped), and if its send_bolo command differs from the current one,
+// the new send_bolo is spawned before anything is swapped in. If any of that
+// fails, the current config and bolo connection are left untouched. Either
+// way, the outcome is reported to bolo via a bmad:reload STATE (as a WARNING,
+// if the last good copy of the remote config document had to be used).
+func ReloadConfig(cfg_file string) (*Config, error) {
+	new_cfg, err := parse_config(cfg_file, true)
+	if err == nil && (cfg == nil || submitter() == nil || new_cfg.Send_bolo != cfg.Send_bolo) {
+		err = reconnect_to_bolo(new_cfg)
+	}
+	if err != nil {
+		report_reload(CRITICAL, "config reload failed: "+err.Error())
+		return cfg, err
+	}
+
+	activate_config(new_cfg)
+	if new_cfg.remote_err != nil {
+		report_reload(WARNING, fmt.Sprintf("config reloaded, using last good copy of %s: %s",
+			new_cfg.Remote.Url, new_cfg.remote_err.Error()))
+	} else {
+		report_reload(OK, "config reloaded successfully")
+	}
+	return cfg, nil
+}
+
+// Reports the outcome of a config reload to bolo as a STATE
+func report_reload(rc int, msg string) {
+	host := "unknown"
+	if cfg != nil {
+		host = cfg.Host
+	}
+	msg = strings.Replace(msg, "\n", " ", -1)
+	if err := SendToBolo(fmt.Sprintf("STATE %d %s:bmad:reload %d %s\n", time.Now().Unix(), host, rc, msg)); err != nil {
+		log.Errorf("Couldn't report config reload status: %s", err.Error())
+	}
+}
+
+// Swaps in a newly parsed config, carrying over the state of any checks
+// from the current config, so that reloads don't disrupt scheduling.
+// Running plugins are kept if they're launched the same way in the new
+// config, and stopped otherwise.
+func activate_config(new_cfg *Config) {
+	if cfg != nil {
+		for _, check := range new_cfg.Checks {
+			if val, ok := cfg.Checks[check.Name]; ok {
+				merge_checks(check, val)
+			}
+		}
+		for name, old := range cfg.Plugins {
+			if plugin, ok := new_cfg.Plugins[name]; ok && plugin.same(old) {
+				old.Kill_after = plugin.Kill_after
+				new_cfg.Plugins[name] = old
+			} else {
+				old.Stop()
+			}
+		}
+	}
+
+	cfg = new_cfg
+	log.SetupLogging(cfg.Log)
+	log.Debugf("Config successfully loaded as: %s", mask_secrets(fmt.Sprintf("%#v", cfg), cfg.secrets))
+}
+
+// Parses and validates the config file specified by cfg_file, along
+// with any auxillary configs, returning the resulting Config. This
+// has no side effects on the current config. Invalid checks, and
+// includes that can't be read, are logged and skipped, unless strict
+// is set, in which case they're returned as an error.
+func parse_config(cfg_file string, strict bool) (*Config, error) {
 	new_cfg := default_config()
 
 	source, err := ioutil.ReadFile(cfg_file)
 	if err != nil {
-		return cfg, err
+		return nil, err
 	}
 
-	err = goyaml.Unmarshal(source, &new_cfg)
+	err = unmarshal_config(cfg_file, source, &new_cfg)
 	if err != nil {
-		return cfg, err
+		return nil, err
+	}
+
+	new_cfg.Send_bolo, new_cfg.secrets, err = interpolate(new_cfg.Send_bolo)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid send_bolo: %s", err.Error()))
+	}
+	if args, err := shellwords.Parse(new_cfg.Send_bolo); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid send_bolo: %s", err.Error()))
+	} else if len(args) == 0 {
+		return nil, errors.New("Invalid send_bolo: no command specified")
 	}
 
-	if new_cfg.Include_dir != "" {
-		log.Debugf("Loading auxillary configs from %s", new_cfg.Include_dir)
-		files, err := filepath.Glob(new_cfg.Include_dir + "/*.conf")
+	switch new_cfg.On_duplicate {
+	case "first", "last", "merge", "error":
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid on_duplicate `%s`, expected one of first, last, merge, or error",
+			new_cfg.On_duplicate))
+	}
+	// the global defaults apply to every check, so they can't be skipped like an invalid check
+	if new_cfg.Bulk == toggle_invalid {
+		return nil, errors.New("Invalid boolean value for global bulk")
+	}
+	if new_cfg.Report == toggle_invalid {
+		return nil, errors.New("Invalid boolean value for global report")
+	}
+	if new_cfg.Exit_state == toggle_invalid {
+		return nil, errors.New("Invalid boolean value for global exit_state")
+	}
+	if new_cfg.Checks == nil {
+		new_cfg.Checks = map[string]*Check{}
+	}
+	if new_cfg.Templates == nil {
+		new_cfg.Templates = map[string]*Check{}
+	}
+	for _, check := range new_cfg.Checks {
+		if check != nil {
+			check.sources = []string{cfg_file}
+		}
+	}
+
+	for _, file := range include_files(new_cfg) {
+		log.Debugf("Loading auxillary config: %s", file)
+		source, err := ioutil.ReadFile(file)
 		if err != nil {
-			log.Warnf("Couldn't find include files: %s", err.Error())
-		} else {
-			for _, file := range files {
-				log.Debugf("Loading auxillary config: %s", file)
-				source, err := ioutil.ReadFile(file)
-				if err != nil {
-					log.Warnf("Couldn't read %q: %s", file, err.Error())
-					continue
-				}
+			if strict {
+				return nil, err
+			}
+			log.Warnf("Couldn't read %q: %s", file, err.Error())
+			continue
+		}
 
-				checks := map[string]*Check{}
-				err = goyaml.Unmarshal(source, &checks)
-				if err != nil {
-					log.Warnf("Could not parse yaml from %q: %s", file, err.Error())
-					continue
-				}
+		checks, templates, err := parse_include(file, source)
+		if err != nil {
+			if strict {
+				return nil, errors.New(fmt.Sprintf("Could not parse config from %q: %s", file, err.Error()))
+			}
+			log.Warnf("Could not parse config from %q: %s", file, err.Error())
+			continue
+		}
+		if err := add_include(new_cfg, file, checks, templates); err != nil {
+			return nil, err
+		}
+	}
 
-				for name, check := range checks {
-					if _, exists := new_cfg.Checks[name]; exists {
-						log.Warnf("Check %q defined in multiple config files, ignoring definition in %s", name, file)
-						continue
-					}
-					new_cfg.Checks[name] = check
-				}
+	if new_cfg.Remote.Url != "" {
+		if new_cfg.Remote.Every < MIN_INTERVAL {
+			new_cfg.Remote.Every = MIN_INTERVAL
+		}
+		if new_cfg.Remote.Timeout <= 0 {
+			new_cfg.Remote.Timeout = 10
+		}
+		var applied *remote_document
+		if cfg != nil && cfg.remote != nil && cfg.remote.meta.Url == new_cfg.Remote.Url {
+			applied = cfg.remote
+		}
+		checks, templates, doc, err := load_remote(new_cfg.Remote, latest_remote(new_cfg.Remote.Url), applied)
+		if err != nil {
+			if doc == nil && strict {
+				return nil, errors.New(fmt.Sprintf("Couldn't load checks from %s: %s", new_cfg.Remote.Url, err.Error()))
+			}
+			log.Warnf("Couldn't load checks from %s: %s", new_cfg.Remote.Url, err.Error())
+			new_cfg.remote_err = err
+		}
+		if doc != nil {
+			new_cfg.remote = doc
+			if err := add_include(new_cfg, new_cfg.Remote.Url, checks, templates); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	for name, check := range new_cfg.Checks {
+	new_cfg.Checks, err = expand_checks(new_cfg.Checks, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	if new_cfg.Plugins == nil {
+		new_cfg.Plugins = map[string]*Plugin{}
+	}
+	var plugins []string
+	for name := range new_cfg.Plugins {
+		plugins = append(plugins, name)
+	}
+	sort.Strings(plugins)
+	for _, name := range plugins {
+		plugin := new_cfg.Plugins[name]
+		if plugin == nil {
+			plugin = &Plugin{}
+		}
+		if err := initialize_plugin(name, plugin, new_cfg); err != nil {
+			if strict {
+				return nil, errors.New(fmt.Sprintf("Invalid plugin config for %s: %s", name, err.Error()))
+			}
+			log.Errorf("Invalid plugin config for %s: %s (skipping)", name, err.Error())
+			delete(new_cfg.Plugins, name)
+			continue
+		}
+		log.Debugf("Plugin %s defined as %s", name, mask_secrets(fmt.Sprintf("%#v", plugin.cmd_args), plugin.secrets))
+	}
+
+	for _, name := range sorted_names(new_cfg.Checks) {
+		check := new_cfg.Checks[name]
 		if err := initialize_check(name, check, new_cfg); err != nil {
+			if strict {
+				return nil, errors.New(fmt.Sprintf("Invalid check config for %s: %s", name, err.Error()))
+			}
 			log.Errorf("Invalid check config for %s: %s (skipping)", name, err.Error())
 			delete(new_cfg.Checks, name)
 			continue
 		}
+		log.Debugf("Check %s (from %s) defined as %s", check.Name, strings.Join(check.sources, ", "),
+			mask_secrets(fmt.Sprintf("%#v", check), check.secrets))
+	}
 
-		if cfg != nil {
-			if val, ok := cfg.Checks[check.Name]; ok {
-				merge_checks(check, val)
+	return new_cfg, nil
+}
+
+// Extensions of the config files loaded from directories (the include_dir,
+// and any directories listed under include)
+var include_extensions = []string{".conf", ".json", ".toml", ".yml", ".yaml"}
+
+// Returns the include entries for a config: the include_dir, followed by
+// each of the include directives, as the patterns each one expands to.
+// Directories expand to a pattern for each of the include_extensions.
+func include_entries(c *Config) [][]string {
+	var entries [][]string
+	dir_patterns := func(dir string) []string {
+		var patterns []string
+		for _, ext := range include_extensions {
+			patterns = append(patterns, filepath.Join(dir, "*"+ext))
+		}
+		return patterns
+	}
+	if c.Include_dir != "" {
+		entries = append(entries, dir_patterns(c.Include_dir))
+	}
+	for _, include := range c.Include {
+		if info, err := os.Stat(include); err == nil && info.IsDir() {
+			entries = append(entries, dir_patterns(include))
+		} else {
+			entries = append(entries, []string{include})
+		}
+	}
+	return entries
+}
+
+// Returns the include patterns for a config, for all of its include entries
+func include_patterns(c *Config) []string {
+	var patterns []string
+	for _, entry := range include_entries(c) {
+		patterns = append(patterns, entry...)
+	}
+	return patterns
+}
+
+// Returns the list of auxillary config files to load for a config, in the
+// order they should be loaded. Files are ordered by the include entry
+// that matched them, and then sorted lexically. Files matching multiple
+// entries are only loaded once.
+func include_files(c *Config) []string {
+	var files []string
+	seen := map[string]bool{}
+	for _, entry := range include_entries(c) {
+		var matches []string
+		for _, pattern := range entry {
+			log.Debugf("Loading auxillary configs from %s", pattern)
+			found, err := glob(pattern)
+			if err != nil {
+				log.Warnf("Couldn't find include files for %s: %s", pattern, err.Error())
+				continue
 			}
+			matches = append(matches, found...)
+		}
+		sort.Strings(matches)
+		for _, file := range matches {
+			if seen[file] {
+				continue
+			}
+			if info, err := os.Stat(file); err == nil && info.IsDir() {
+				continue
+			}
+			seen[file] = true
+			files = append(files, file)
 		}
-		log.Debugf("Check %s defined as %#v", check.Name, check)
 	}
+	return files
+}
 
-	cfg = new_cfg
-	log.SetupLogging(cfg.Log)
-	log.Debugf("Config successfully loaded as: %#v", cfg)
-	return cfg, nil
+// Expands a glob pattern like filepath.Glob, with the addition of '**'
+// matching zero or more directories (e.g. /etc/bmad.d/**/*.yml).
+// Matches are returned sorted lexically.
+func glob(pattern string) ([]string, error) {
+	idx := strings.Index(pattern, "**")
+	if idx < 0 {
+		matches, err := filepath.Glob(pattern)
+		sort.Strings(matches)
+		return matches, err
+	}
+
+	base := filepath.Clean(pattern[:idx])
+	rest := strings.TrimPrefix(pattern[idx+2:], string(filepath.Separator))
+	if rest == "" {
+		rest = "*"
+	}
+	var matches []string
+	seen := map[string]bool{}
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Warnf("Couldn't search %s for include files: %s", path, err.Error())
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		found, err := glob(filepath.Join(path, rest))
+		if err != nil {
+			return err
+		}
+		for _, match := range found {
+			if !seen[match] {
+				seen[match] = true
+				matches = append(matches, match)
+			}
+		}
+		return nil
+	})
+	sort.Strings(matches)
+	return matches, err
+}
+
+// Parses an auxillary config file (whose contents are in source),
+// returning the checks and templates it defines. Auxillary configs are hashes of checks, with the exception
+// of the reserved 'templates' key, which holds a hash of check templates,
+// and the reserved 'defaults' key, which holds directives that apply to all
+// of the checks in the file (unless set by the check or its template).
+func parse_include(file string, source []byte) (map[string]*Check, map[string]*Check, error) {
+	checks := map[string]*Check{}
+	if err := unmarshal_config(file, source, &checks); err != nil {
+		return nil, nil, err
+	}
+	var reserved struct {
+		Templates map[string]*Check
+		Defaults  *Check
+	}
+	if err := unmarshal_config(file, source, &reserved); err != nil {
+		return nil, nil, err
+	}
+	delete(checks, "templates")
+	delete(checks, "defaults")
+
+	for _, check := range checks {
+		if check != nil {
+			check.file_defaults = reserved.Defaults
+		}
+	}
+	return checks, reserved.Templates, nil
+}
+
+// Adds the checks and templates defined in an auxillary config (file)
+// to new_cfg. Templates are first-come first-served, and checks are added
+// in order of their names, so conflicts are resolved deterministically.
+func add_include(new_cfg *Config, file string, checks map[string]*Check, templates map[string]*Check) error {
+	for name, tmpl := range templates {
+		if _, exists := new_cfg.Templates[name]; exists {
+			log.Warnf("Template %q defined in multiple config files, ignoring definition in %s", name, file)
+			continue
+		}
+		new_cfg.Templates[name] = tmpl
+	}
+	for _, name := range sorted_names(checks) {
+		if err := add_check(new_cfg, name, checks[name], file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a check defined in file to new_cfg, resolving any conflicts with
+// previously defined checks of the same name according to the on_duplicate
+// policy of new_cfg:
+//
+//	first   the earliest definition is kept, and later ones are ignored
+//	last    the latest definition replaces any earlier ones
+//	merge   directives set in the later definition override those of the earlier one
+//	error   duplicate definitions are a config error
+func add_check(new_cfg *Config, name string, check *Check, file string) error {
+	if check == nil {
+		check = &Check{}
+	}
+	existing, exists := new_cfg.Checks[name]
+	if !exists || existing == nil {
+		check.sources = []string{file}
+		new_cfg.Checks[name] = check
+		return nil
+	}
+
+	switch new_cfg.On_duplicate {
+	case "error":
+		return errors.New(fmt.Sprintf("Check %q is defined in both %s and %s",
+			name, strings.Join(existing.sources, ", "), file))
+	case "last":
+		log.Warnf("Check %q defined in multiple config files, replacing definition from %s with %s",
+			name, strings.Join(existing.sources, ", "), file)
+		check.sources = []string{file}
+		new_cfg.Checks[name] = check
+	case "merge":
+		log.Debugf("Check %q defined in multiple config files, merging definition from %s into %s",
+			name, file, strings.Join(existing.sources, ", "))
+		inherit_check(check, existing)
+		if check.file_defaults == nil {
+			check.file_defaults = existing.file_defaults
+		}
+		check.sources = append(existing.sources, file)
+		new_cfg.Checks[name] = check
+	default:
+		log.Warnf("Check %q defined in multiple config files, ignoring definition in %s", name, file)
+	}
+	return nil
+}
+
+// Returns the names of a hash of checks, sorted, so that
+// they can be processed in a deterministic order
+func sorted_names(checks map[string]*Check) []string {
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Placeholder substituted with each value when generating checks via foreach/glob
+const ITEM_PLACEHOLDER string = "{{item}}"
+
+// Expands any checks defined with a foreach list, or glob pattern, into one
+// check per value, substituting the value in for {{item}} in the check's name,
+// command, env, and params values. Checks that can't be expanded are skipped (or
+// returned as an error, if strict is set), as are generated checks whose names clash
+// with another check.
+func expand_checks(checks map[string]*Check, strict bool) (map[string]*Check, error) {
+	expanded := map[string]*Check{}
+	generated := map[string]*Check{}
+	for key, check := range checks {
+		if check == nil || (len(check.Foreach) == 0 && check.Glob == "") {
+			expanded[key] = check
+			continue
+		}
+		items, err := expansion_items(key, check)
+		if err != nil {
+			if strict {
+				return nil, errors.New(fmt.Sprintf("Invalid check config for %s: %s", key, err.Error()))
+			}
+			log.Errorf("Invalid check config for %s: %s (skipping)", key, err.Error())
+			continue
+		}
+
+		name := check.Name
+		if name == "" {
+			name = key
+		}
+		for i, item := range items {
+			gen := *check
+			gen.Foreach = nil
+			gen.Glob = ""
+			gen.Name = strings.Replace(name, ITEM_PLACEHOLDER, item, -1)
+			// the rest is substituted by initialize_check, once the
+			// check has inherited from its template and file defaults
+			gen.item = &items[i]
+			if _, exists := generated[gen.Name]; exists {
+				log.Warnf("Check %q generated multiple times by %s, ignoring duplicate", gen.Name, key)
+				continue
+			}
+			log.Debugf("Generated check %s from %s", gen.Name, key)
+			generated[gen.Name] = &gen
+		}
+	}
+
+	for name, check := range generated {
+		if _, exists := expanded[name]; exists {
+			log.Warnf("Generated check %q conflicts with an existing check, ignoring generated definition", name)
+			continue
+		}
+		expanded[name] = check
+	}
+	return expanded, nil
+}
+
+// Substitutes the value a Check was generated with (via foreach or glob)
+// into its command, env, and params
+func (self *Check) expand_item(item string) {
+	self.Command = strings.Replace(self.Command, ITEM_PLACEHOLDER, item, -1)
+	self.Env = replace_item(self.Env, item)
+	self.Params = replace_item(self.Params, item)
+}
+
+// Returns a copy of m with item substituted into its values (maps may
+// be shared with other checks generated from the same definition, or
+// inherited from a template, so they're never modified in place)
+func replace_item(m map[string]string, item string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	replaced := map[string]string{}
+	for k, v := range m {
+		replaced[k] = strings.Replace(v, ITEM_PLACEHOLDER, item, -1)
+	}
+	return replaced
+}
+
+// Returns the list of values a foreach/glob check should be expanded with
+func expansion_items(key string, check *Check) ([]string, error) {
+	if len(check.Foreach) > 0 && check.Glob != "" {
+		return nil, errors.New("foreach and glob cannot be used together")
+	}
+	name := check.Name
+	if name == "" {
+		name = key
+	}
+	if !strings.Contains(name, ITEM_PLACEHOLDER) {
+		return nil, errors.New(fmt.Sprintf("Check name must contain %s when using foreach or glob", ITEM_PLACEHOLDER))
+	}
+	if check.Glob == "" {
+		return check.Foreach, nil
+	}
+
+	items, err := filepath.Glob(check.Glob)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to expand glob `%s`: %s", check.Glob, err.Error()))
+	}
+	if len(items) == 0 {
+		log.Warnf("Glob `%s` for %s matched nothing, no checks generated", check.Glob, key)
+	}
+	return items, nil
+}
+
+// Looks up a template by name, and returns a copy of it with any
+// templates it uses (and any they use, etc.) already applied
+func resolve_template(name string, templates map[string]*Check, seen []string) (*Check, error) {
+	for _, s := range seen {
+		if s == name {
+			return nil, errors.New(fmt.Sprintf("Template loop detected: %s -> %s",
+				strings.Join(seen, " -> "), name))
+		}
+	}
+	tmpl, ok := templates[name]
+	if !ok || tmpl == nil {
+		return nil, errors.New(fmt.Sprintf("Unknown template `%s`", name))
+	}
+
+	var resolved Check
+	inherit_check(&resolved, tmpl)
+	if resolved.Use != "" {
+		parent, err := resolve_template(resolved.Use, templates, append(seen, name))
+		if err != nil {
+			return nil, err
+		}
+		inherit_check(&resolved, parent)
+	}
+	return &resolved, nil
+}
+
+// Fills in any configuration directives left unset on check
+// with the values from parent. Maps (like Env) are merged, with
+// any conflicts being chosen in favor of the check's value.
+func inherit_check(check *Check, parent *Check) {
+	inherit_fields(reflect.ValueOf(check).Elem(), reflect.ValueOf(parent).Elem())
+}
+
+func inherit_fields(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		from := src.Field(i)
+		switch field.Kind() {
+		case reflect.Map:
+			if from.IsNil() {
+				continue
+			}
+			if field.IsNil() {
+				field.Set(reflect.MakeMap(field.Type()))
+			}
+			for _, key := range from.MapKeys() {
+				if !field.MapIndex(key).IsValid() {
+					field.SetMapIndex(key, from.MapIndex(key))
+				}
+			}
+		case reflect.Struct:
+			inherit_fields(field, from)
+		default:
+			if field.IsZero() {
+				field.Set(from)
+			}
+		}
+	}
 }
 
 // Function-variable to perform initial scheduling of a check, upon config generation.
@@ -177,9 +811,11 @@ var first_run = func(interval int64) time.Time {
 	return time.Now().Add(time.Duration(rand.Int63n(interval * int64(time.Second))))
 }
 
-// Takes a new check, and initializes it based on global config defaults, and
-// hard-coded safeguards, to ensure checks don't run *too* frequently, or get
-// configured in a messed up way (like setting Timeout above Every, or to 0)
+// Takes a new check, and initializes it based on its template (if any), global
+// config defaults, and hard-coded safeguards, to ensure checks don't run *too*
+// frequently, or get configured in a messed up way (like setting Timeout above
+// Every, or to 0). Values are taken from the check first, then its template,
+// then the defaults of the file it was defined in, and lastly the global defaults.
 func initialize_check(name string, check *Check, defaults *Config) error {
 	if check.Name == "" {
 		check.Name = name
@@ -187,7 +823,57 @@ func initialize_check(name string, check *Check, defaults *Config) error {
 	if check.Name == "" {
 		return errors.New("No check name specified")
 	}
-	if check.Command == "" {
+	if check.Use == "" && check.file_defaults != nil {
+		check.Use = check.file_defaults.Use
+	}
+	if check.Use != "" {
+		tmpl, err := resolve_template(check.Use, defaults.Templates, nil)
+		if err != nil {
+			return err
+		}
+		inherit_check(check, tmpl)
+	}
+	if check.file_defaults != nil {
+		inherit_check(check, check.file_defaults)
+	}
+	if check.item != nil {
+		check.expand_item(*check.item)
+		check.item = nil
+	}
+	if check.Env == nil {
+		check.Env = map[string]string{}
+	}
+	for key, val := range defaults.Env {
+		if _, ok := check.Env[key]; !ok {
+			check.Env[key] = val
+		}
+	}
+
+	check.secrets = nil
+	for key, val := range check.Params {
+		var err error
+		if check.Params[key], err = check.interpolate(val); err != nil {
+			return err
+		}
+	}
+	if check.Builtin != "" {
+		if check.Command != "" {
+			return errors.New("Checks cannot have both a command and a builtin")
+		}
+		if check.Plugin != "" {
+			return errors.New("Checks cannot have both a builtin and a plugin")
+		}
+		if err := validate_builtin(check.Builtin, check.Params); err != nil {
+			return err
+		}
+	} else if check.Plugin != "" {
+		if check.Command != "" {
+			return errors.New("Checks cannot have both a command and a plugin")
+		}
+		if _, ok := defaults.Plugins[check.Plugin]; !ok {
+			return errors.New(fmt.Sprintf("Unknown plugin `%s`", check.Plugin))
+		}
+	} else if check.Command == "" {
 		return errors.New("Unspecified command")
 	} else {
 		var err error
@@ -196,7 +882,39 @@ func initialize_check(name string, check *Check, defaults *Config) error {
 			return errors.New(fmt.Sprintf("Unable to parse command `%s`: %s",
 				check.Command, err.Error()))
 		}
+		for i, arg := range check.cmd_args {
+			if check.cmd_args[i], err = check.interpolate(arg); err != nil {
+				return err
+			}
+		}
+	}
+	for key, val := range check.Env {
+		var err error
+		if check.Env[key], err = check.interpolate(val); err != nil {
+			return err
+		}
+	}
+	if check.Stdin != "" {
+		var err error
+		if check.Stdin, err = check.interpolate(check.Stdin); err != nil {
+			return err
+		}
 	}
+	if check.Cwd != "" && !filepath.IsAbs(check.Cwd) {
+		return errors.New(fmt.Sprintf("Invalid cwd `%s`, expected an absolute path", check.Cwd))
+	}
+	if _, ok := parse_umask(check.Umask); check.Umask != "" && !ok {
+		return errors.New(fmt.Sprintf("Invalid umask `%s`, expected an octal value between 000 and 777", check.Umask))
+	}
+	inherit_fields(reflect.ValueOf(&check.Limits).Elem(), reflect.ValueOf(&defaults.Limits).Elem())
+	if err := check.Limits.validate(); err != nil {
+		return err
+	}
+	inherit_fields(reflect.ValueOf(&check.Cgroup).Elem(), reflect.ValueOf(&defaults.Cgroup).Elem())
+	if err := check.Cgroup.validate(); err != nil {
+		return err
+	}
+
 	if check.Every <= 0 {
 		check.Every = defaults.Every
 	} else if check.Every <= MIN_INTERVAL {
@@ -223,27 +941,96 @@ func initialize_check(name string, check *Check, defaults *Config) error {
 	if check.Timeout <= 0 {
 		check.Timeout = defaults.Timeout
 	}
-	if check.Timeout >= check.Retry_every || check.Timeout <= 0 {
+	if check.Allow_long_timeout == toggle_invalid {
+		return errors.New("Invalid boolean value for allow_long_timeout")
+	}
+	switch check.Mode {
+	case "", MODE_SCHEDULED, MODE_PERSISTENT:
+	default:
+		return errors.New(fmt.Sprintf("Invalid mode `%s`, expected scheduled or persistent", check.Mode))
+	}
+	if check.Persistent() && check.Builtin != "" {
+		return errors.New("builtin checks cannot be persistent")
+	}
+	if check.Persistent() && check.Plugin != "" {
+		return errors.New("plugin checks cannot be persistent")
+	}
+	// persistent checks run indefinitely, so timeouts don't apply to them
+	if !check.Persistent() && (check.Timeout <= 0 || (check.Timeout >= check.Retry_every && !check.Allow_long_timeout.On())) {
 		check.Timeout = check.Retry_every - 1
 	}
+	if _, ok := parse_signal(check.Timeout_signal); !ok {
+		return errors.New(fmt.Sprintf("Invalid timeout_signal `%s`", check.Timeout_signal))
+	}
+	if check.Kill_after != nil && *check.Kill_after < 0 {
+		return errors.New(fmt.Sprintf("Invalid kill_after %d, expected 0 or more seconds", *check.Kill_after))
+	}
+	if check.Report_timeout == toggle_invalid {
+		return errors.New("Invalid boolean value for report_timeout")
+	}
+	if _, err := parse_exit_codes(check.Exit_codes); err != nil {
+		return err
+	}
+	if _, ok := parse_state(check.Signal_rc); !ok {
+		return errors.New(fmt.Sprintf("Invalid signal_rc `%s`, expected OK, WARNING, CRITICAL, or UNKNOWN", check.Signal_rc))
+	}
+	if check.Max_output == 0 {
+		check.Max_output = defaults.Max_output
+	}
+	if check.Max_output < 0 {
+		return errors.New(fmt.Sprintf("Invalid max_output %d, expected a positive number of bytes", check.Max_output))
+	}
+	if check.Max_stderr == 0 {
+		check.Max_stderr = defaults.Max_stderr
+	}
+	if check.Max_stderr < 0 {
+		return errors.New(fmt.Sprintf("Invalid max_stderr %d, expected a positive number of bytes", check.Max_stderr))
+	}
 
-	if check.Bulk == "" {
+	if check.Bulk == toggle_invalid {
+		return errors.New("Invalid boolean value for bulk")
+	}
+	if check.Report == toggle_invalid {
+		return errors.New("Invalid boolean value for report")
+	}
+	if check.Exit_state == toggle_invalid {
+		return errors.New("Invalid boolean value for exit_state")
+	}
+	report_requested := check.Report.On()
+	exit_state_requested := check.Exit_state.On()
+	if check.Bulk == TOGGLE_UNSET {
 		check.Bulk = defaults.Bulk
 	}
-	if check.Report == "" {
+	if check.Report == TOGGLE_UNSET {
 		check.Report = defaults.Report
 	}
-
-	for key, val := range defaults.Env {
-		if _, ok := check.Env[key]; !ok {
-			check.Env[key] = val
-		}
+	if check.Exit_state == TOGGLE_UNSET {
+		check.Exit_state = defaults.Exit_state
 	}
-	if check.Env == nil {
-		check.Env = map[string]string{}
+	if check.Persistent() {
+		// persistent checks never finish, so their output has to be streamed
+		check.Bulk = TOGGLE_ON
+		check.Stream = TOGGLE_ON
+	}
+	if report_requested && !check.Bulk.On() {
+		return errors.New("report is only supported for bulk checks (use exit_state for non-bulk checks)")
+	}
+	if exit_state_requested && check.Bulk.On() {
+		return errors.New("exit_state is only supported for non-bulk checks (use report for bulk checks)")
+	}
+	if check.Stream == toggle_invalid {
+		return errors.New("Invalid boolean value for stream")
+	}
+	if check.Stream.On() && !check.Bulk.On() {
+		return errors.New("stream is only supported for bulk checks")
 	}
 
-	check.next_run = first_run(check.Every)
+	if check.Persistent() {
+		// start persistent checks right away
+		check.next_run = time.Time{}
+	} else {
+		check.next_run = first_run(check.Every)
+	}
 
 	return nil
 }
@@ -3,7 +3,13 @@ package bma
 import "testing"
 import "github.com/stretchr/testify/assert"
 import "errors"
+import "launchpad.net/goyaml"
+import "io/ioutil"
 import "os"
+import "os/exec"
+import "regexp"
+import "sort"
+import "strings"
 import "time"
 
 func TestHostname(t *testing.T) {
@@ -76,7 +82,12 @@ func TestDefaultConfig(t *testing.T) {
 		Send_bolo:   "send_bolo -t stream",
 		Host:        "test01.example.com",
 		Include_dir: "/etc/bmad.d",
+		Watch_delay: 2,
+		On_duplicate: "first",
+		Remote:      Remote{Every: 300, Timeout: 10, Cache: "/var/cache/bmad/remote"},
 		Checks:      map[string]*Check{},
+		Templates:   map[string]*Check{},
+		Plugins:     map[string]*Plugin{},
 		Env:         map[string]string{},
 	}
 	assert.Equal(t, &expect, default_config(), "default_config() returns expected config")
@@ -124,6 +135,7 @@ func TestLoadConfig(t *testing.T) {
 		Name:        "first",
 		cmd_args:    []string{"echo", "success"},
 		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/basic.yml"},
 	}
 	// There is a "second" key in the yaml file, with no check command
 	// found. It should be ingored on config load, so we don't run it needlessly
@@ -137,6 +149,7 @@ func TestLoadConfig(t *testing.T) {
 	os.Chmod("t/data/bmad.d/unreadable.conf", 0644)
 	// This directory should have both a more.conf (parseable), and a bad.conf (unparseable)
 	expect.Include_dir = "t/data/bmad.d"
+	expect.Checks["first"].sources = []string{"t/data/extended.yml"}
 	expect.Checks["third"] = &Check{
 		Command:     "echo \"third success\"",
 		Every:       30,
@@ -147,6 +160,7 @@ func TestLoadConfig(t *testing.T) {
 		Name:        "third",
 		cmd_args:    []string{"echo", "third success"},
 		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/bmad.d/more.conf"},
 	}
 	// There is a redefinition of "second" in t/data/bmad.d/more.yml.
 	// Unfortunately, bmad takes the first earliest found definition,
@@ -169,11 +183,496 @@ func TestLoadConfig(t *testing.T) {
 	expect.Checks["first"].Retry_every = 60
 	expect.Checks["first"].Retries     = 10
 	expect.Checks["first"].Timeout     = 50
+	expect.Checks["first"].sources     = []string{"t/data/reloaded.yml"}
 
 	got, err = LoadConfig("t/data/reloaded.yml")
 	assert.Equal(t, expect, got, "LoadConfig('t/data/reloaded.yml') updates config properly on reload")
 }
 
+func TestLoadConfigTemplates(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	cfg = nil // Reset cfg
+	got, err := LoadConfig("t/data/templates.yml")
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+	assert.Len(t, got.Templates, 3, "templates from the main config and include_dir are loaded")
+
+	assert.Equal(t, &Check{
+		Command:     "/usr/lib/bolo/collectors/base",
+		Every:       60,
+		Retry_every: 30,
+		Retries:     2,
+		Timeout:     20,
+		Run_as:      "nobody",
+		Env:         map[string]string{"GLOBAL": "global", "TEMPLATE": "base", "LEVEL": "base"},
+		Name:        "simple",
+		Use:         "base",
+		cmd_args:    []string{"/usr/lib/bolo/collectors/base"},
+		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/templates.yml"},
+	}, got.Checks["simple"], "checks inherit from their template, then the global defaults")
+
+	assert.Equal(t, &Check{
+		Command:     "/usr/lib/bolo/collectors/layered --fast",
+		Every:       60,
+		Retry_every: 30,
+		Retries:     2,
+		Timeout:     20,
+		Run_as:      "nobody",
+		Bulk:        TOGGLE_ON,
+		Env:         map[string]string{"GLOBAL": "global", "TEMPLATE": "base", "LEVEL": "derived", "CHECK": "layered"},
+		Name:        "layered",
+		Use:         "derived",
+		cmd_args:    []string{"/usr/lib/bolo/collectors/layered", "--fast"},
+		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/templates.yml"},
+	}, got.Checks["layered"], "multi-level template inheritance prefers the most specific values")
+
+	assert.Equal(t, &Check{
+		Command:     "/usr/lib/bolo/collectors/base",
+		Every:       120,
+		Retry_every: 30,
+		Retries:     2,
+		Timeout:     15,
+		Run_as:      "nobody",
+		Bulk:        TOGGLE_ON,
+		Report:      TOGGLE_ON,
+		Env:         map[string]string{"GLOBAL": "global", "TEMPLATE": "base", "LEVEL": "base"},
+		Name:        "team_check",
+		Use:         "team",
+		cmd_args:    []string{"/usr/lib/bolo/collectors/base"},
+		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/bmad.templates/team.conf"},
+	}, got.Checks["team_check"], "templates defined in include_dir files can be used")
+
+	_, exists := got.Checks["missing"]
+	assert.False(t, exists, "checks using unknown templates are skipped")
+	assert.Equal(t, map[string]string{"TEMPLATE": "base", "LEVEL": "base"}, got.Templates["base"].Env,
+		"templates are not modified by the checks inheriting from them")
+}
+
+func TestLoadConfigForeach(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	cfg = nil // Reset cfg
+	got, err := LoadConfig("t/data/foreach.yml")
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+
+	var names []string
+	for name := range got.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"conf:t/data/bmad.d/bad.conf",
+		"conf:t/data/bmad.d/more.conf",
+		"conf:t/data/bmad.d/unreadable.conf",
+		"df_/",
+		"df_/var",
+		"disk_home",
+		"disk_root",
+		"disk_var",
+		"proc_nginx",
+	}, names, "foreach and glob checks are expanded into one check per value")
+
+	assert.Equal(t, &Check{
+		Command:     "check_disk --mount root",
+		Every:       10,
+		Retry_every: 6,
+		Retries:     2,
+		Timeout:     5,
+		Env:         map[string]string{"MOUNT": "root"},
+		Name:        "disk_root",
+		cmd_args:    []string{"check_disk", "--mount", "root"},
+		next_run:    time.Unix(42,0),
+		sources:     []string{"t/data/foreach.yml"},
+	}, got.Checks["disk_root"], "the value is substituted into name, command, and env")
+
+	assert.Equal(t, "check_disk --mount /var --special", got.Checks["disk_var"].Command,
+		"explicitly defined checks win over generated checks")
+	assert.Equal(t, []string{"cat", "t/data/bmad.d/more.conf"}, got.Checks["conf:t/data/bmad.d/more.conf"].cmd_args,
+		"glob matches are substituted into the command")
+	assert.Equal(t, map[string]string{"name": "nginx"}, got.Checks["proc_nginx"].Params,
+		"the value is substituted into builtin params")
+	assert.Equal(t, []string{"/bin/df", "/var"}, got.Checks["df_/var"].cmd_args,
+		"the value is substituted into commands inherited from templates")
+	assert.Equal(t, "/var", got.Checks["df_/var"].Env["MOUNT"], "the value is substituted into env inherited from templates")
+	assert.Equal(t, []string{"/bin/df", "/"}, got.Checks["df_/"].cmd_args,
+		"each generated check gets its own value")
+	assert.Equal(t, "{{item}}", got.Templates["df"].Env["MOUNT"], "templates are left as-is")
+}
+
+func TestLoadConfigIncludes(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	cfg = nil // Reset cfg
+	os.Chmod("t/data/bmad.d/unreadable.conf", 0200)
+	got, err := LoadConfig("t/data/include.yml")
+	os.Chmod("t/data/bmad.d/unreadable.conf", 0644)
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+
+	assert.Equal(t, []string{
+		"t/data/bmad.tree/base.yml",
+		"t/data/bmad.tree/team1/checks.yml",
+		"t/data/bmad.tree/team2/sub/checks.yml",
+		"t/data/bmad.d/bad.conf",
+		"t/data/bmad.d/more.conf",
+		"t/data/bmad.d/unreadable.conf",
+	}, include_files(got), "include files are found recursively, in a deterministic order, without duplicates")
+
+	var names []string
+	for name := range got.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"base_check", "first", "team1_check", "team1_override", "team1_templated", "team2_check", "third"},
+		names, "checks are loaded from all include patterns")
+	assert.Equal(t, "echo \"base\"", got.Checks["base_check"].Command, "the earliest definition of a check wins")
+
+	assert.Equal(t, &Check{
+		Command:     "echo \"team1\"",
+		Every:       60,
+		Retry_every: 6,
+		Retries:     2,
+		Timeout:     5,
+		Run_as:      "team1",
+		Env:         map[string]string{"TEAM": "team1"},
+		Name:        "team1_check",
+		cmd_args:    []string{"echo", "team1"},
+		next_run:    time.Unix(42,0),
+		file_defaults: got.Checks["team1_check"].file_defaults,
+		sources:     []string{"t/data/bmad.tree/team1/checks.yml"},
+	}, got.Checks["team1_check"], "per-file defaults apply to the checks in the file")
+	assert.Equal(t, int64(120), got.Checks["team1_override"].Every, "checks override per-file defaults")
+	assert.Equal(t, "team1", got.Checks["team1_override"].Run_as, "checks override per-file defaults")
+	assert.Equal(t, map[string]string{"TEAM": "override"}, got.Checks["team1_override"].Env, "checks override per-file env")
+	assert.Equal(t, int64(300), got.Checks["team1_templated"].Every, "templates take precedence over per-file defaults")
+	assert.Equal(t, "slowpoke", got.Checks["team1_templated"].Run_as, "templates take precedence over per-file defaults")
+	assert.Equal(t, map[string]string{"TEAM": "team1"}, got.Checks["team1_templated"].Env, "per-file defaults fill in what templates don't set")
+	assert.Equal(t, "", got.Checks["team2_check"].Run_as, "per-file defaults don't leak into other files")
+	assert.Equal(t, "", got.Checks["first"].Run_as, "per-file defaults don't leak into the main config")
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	orig_osh := os_hostname
+	os_hostname = func () (string, error) {
+		return "test01.example.com", nil
+	}
+	defer func () { os_hostname = orig_osh }()
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	cfg = nil // Reset cfg
+	expect, err := LoadConfig("t/data/basic.yml")
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+
+	for _, file := range []string{"t/data/basic.json", "t/data/basic.toml"} {
+		cfg = nil // Reset cfg
+		got, err := LoadConfig(file)
+		assert.Nil(t, err, "LoadConfig('%s') doesn't return an error", file)
+		expect.Checks["first"].sources = []string{file}
+		assert.Equal(t, expect, got, "LoadConfig('%s') provides the same config as its yaml equivalent", file)
+	}
+
+	cfg = nil // Reset cfg
+	_, err = LoadConfig("t/data/bad.json")
+	assert.EqualError(t, err, "JSON error: unexpected EOF", "LoadConfig() on bad json returns an error")
+
+	cfg = nil // Reset cfg
+	_, err = LoadConfig("t/data/bad.toml")
+	assert.Contains(t, err.Error(), "TOML error: ", "LoadConfig() on bad toml returns an error")
+
+	cfg = nil // Reset cfg
+	got, err := LoadConfig("t/data/formats.yml")
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+
+	var names []string
+	for name := range got.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"json_check", "toml_check", "toml_long_timeout"}, names,
+		"checks are loaded from json and toml includes, skipping broken files and invalid checks")
+
+	assert.Equal(t, &Check{
+		Command:     "echo \"json\"",
+		Every:       60,
+		Retry_every: 6,
+		Retries:     2,
+		Timeout:     3,
+		Bulk:        TOGGLE_ON,
+		Report:      TOGGLE_ON,
+		Env:         map[string]string{"SOURCE": "json"},
+		Name:        "json_check",
+		cmd_args:    []string{"echo", "json"},
+		next_run:    time.Unix(42,0),
+		file_defaults: got.Checks["json_check"].file_defaults,
+		sources:     []string{"t/data/bmad.formats/generated.json"},
+	}, got.Checks["json_check"], "json checks are parsed like yaml checks")
+
+	assert.Equal(t, &Check{
+		Command:     "echo \"toml\"",
+		Every:       120,
+		Retry_every: 6,
+		Retries:     4,
+		Timeout:     5,
+		Env:         map[string]string{"SOURCE": "toml"},
+		Name:        "toml_check",
+		cmd_args:    []string{"echo", "toml"},
+		next_run:    time.Unix(42,0),
+		file_defaults: got.Checks["toml_check"].file_defaults,
+		sources:     []string{"t/data/bmad.formats/generated.toml"},
+	}, got.Checks["toml_check"], "toml checks are parsed like yaml checks")
+	assert.Equal(t, int64(5), got.Checks["toml_long_timeout"].Timeout, "toml checks are validated like yaml checks")
+
+	source, err := ioutil.ReadFile("t/data/formats.yml")
+	if err != nil {
+		t.Fatalf("Couldn't read formats.yml: %s", err.Error())
+	}
+	os.Mkdir("t/tmp", 0755)
+	for include, replacement := range map[string]string{
+		"include": "include:\n  - t/data/bmad.formats\n",
+		"include_dir": "include_dir: t/data/bmad.formats\n",
+	} {
+		file := "t/tmp/formats-dir.yml"
+		dir_source := strings.Replace(string(source), "include_dir: \"\"\ninclude:\n  - t/data/bmad.formats/*\n", replacement, 1)
+		if dir_source == string(source) {
+			t.Fatalf("Couldn't replace the glob include in formats.yml")
+		}
+		ioutil.WriteFile(file, []byte(dir_source), 0644)
+		cfg = nil // Reset cfg
+		got, err = LoadConfig(file)
+		os.Remove(file)
+		assert.Nil(t, err, "LoadConfig() with a directory %s doesn't return an error", include)
+		assert.Equal(t, []string{"t/data/bmad.formats/broken.json", "t/data/bmad.formats/generated.json", "t/data/bmad.formats/generated.toml"},
+			include_files(got), "json and toml files are found in %s directories", include)
+		assert.NotNil(t, got.Checks["json_check"], "json checks are loaded from %s directories", include)
+		assert.NotNil(t, got.Checks["toml_check"], "toml checks are loaded from %s directories", include)
+	}
+}
+
+func TestLoadConfigDuplicates(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	source, err := ioutil.ReadFile("t/data/duplicates.yml")
+	if err != nil {
+		t.Fatalf("Couldn't read duplicates.yml: %s", err.Error())
+	}
+	os.Mkdir("t/tmp", 0755)
+	load := func (policy string) (*Config, error) {
+		file := "t/tmp/duplicates-" + policy + ".yml"
+		ioutil.WriteFile(file, []byte(strings.Replace(string(source), "on_duplicate: merge", "on_duplicate: " + policy, 1)), 0644)
+		defer os.Remove(file)
+		cfg = nil // Reset cfg
+		return LoadConfig(file)
+	}
+
+	got, err := load("merge")
+	assert.NoError(t, err, "No errors merging duplicate checks")
+	assert.Equal(t, &Check{
+		Command:     "/usr/lib/bolo/collectors/packaged",
+		Every:       300,
+		Retry_every: 6,
+		Retries:     2,
+		Timeout:     5,
+		Env:         map[string]string{"MODE": "packaged", "SITE": "east"},
+		Name:        "packaged",
+		cmd_args:    []string{"/usr/lib/bolo/collectors/packaged"},
+		next_run:    time.Unix(42,0),
+		sources:     []string{"t/tmp/duplicates-merge.yml", "t/data/bmad.dups/10-site.conf", "t/data/bmad.dups/20-tuning.conf"},
+	}, got.Checks["packaged"], "merge overlays the directives set in each later definition")
+	assert.Equal(t, []string{"t/data/bmad.dups/20-tuning.conf"}, got.Checks["local"].Sources(),
+		"checks report which file they came from")
+
+	got, err = load("first")
+	assert.NoError(t, err, "No errors keeping the first definition of duplicate checks")
+	assert.Equal(t, int64(60), got.Checks["packaged"].Every, "first keeps the earliest definition")
+	assert.Equal(t, map[string]string{"MODE": "packaged", "SITE": "default"}, got.Checks["packaged"].Env,
+		"first keeps the earliest definition")
+	assert.Equal(t, []string{"t/tmp/duplicates-first.yml"}, got.Checks["packaged"].Sources(),
+		"checks report which file they came from")
+
+	got, err = load("last")
+	assert.NoError(t, err, "No errors keeping the last definition of duplicate checks")
+	_, exists := got.Checks["packaged"]
+	assert.False(t, exists, "last keeps the latest definition (which is invalid, having no command)")
+	assert.NotNil(t, got.Checks["local"], "unique checks are unaffected by the duplicate policy")
+
+	_, err = load("error")
+	assert.EqualError(t, err, "Check \"packaged\" is defined in both t/tmp/duplicates-error.yml and t/data/bmad.dups/10-site.conf",
+		"error fails the config load on duplicate checks")
+
+	_, err = load("sometimes")
+	assert.EqualError(t, err, "Invalid on_duplicate `sometimes`, expected one of first, last, merge, or error",
+		"unknown duplicate policies fail the config load")
+}
+
+func TestLoadConfigGlobalToggles(t *testing.T) {
+	os.Mkdir("t/tmp", 0755)
+	for _, toggle := range []string{"bulk", "report", "exit_state"} {
+		file := "t/tmp/toggle-" + toggle + ".yml"
+		ioutil.WriteFile(file, []byte("send_bolo: t/bin/send_bolo\ninclude_dir: t/data/bmad.empty\n"+
+			toggle+": maybe\nchecks:\n  first:\n    command: /bin/true\n"), 0644)
+
+		cfg = nil // Reset cfg
+		_, err := LoadConfig(file)
+		assert.EqualError(t, err, "Invalid boolean value for global "+toggle,
+			"unparseable global %s values fail the config load", toggle)
+		_, err = ReloadConfig(file)
+		assert.EqualError(t, err, "Invalid boolean value for global "+toggle,
+			"unparseable global %s values fail config reloads", toggle)
+		os.Remove(file)
+	}
+}
+
+func Test_glob(t *testing.T) {
+	got, err := glob("t/data/bmad.tree/**/*.yml")
+	assert.NoError(t, err, "No errors globbing recursively")
+	assert.Equal(t, []string{
+		"t/data/bmad.tree/base.yml",
+		"t/data/bmad.tree/team1/checks.yml",
+		"t/data/bmad.tree/team2/sub/checks.yml",
+	}, got, "** matches zero or more directories")
+
+	got, err = glob("t/data/bmad.tree/**")
+	assert.NoError(t, err, "No errors globbing recursively")
+	assert.Contains(t, got, "t/data/bmad.tree/team2/notes.txt", "trailing ** matches everything beneath it")
+
+	got, err = glob("t/data/bmad.tree/*/checks.yml")
+	assert.NoError(t, err, "No errors globbing")
+	assert.Equal(t, []string{"t/data/bmad.tree/team1/checks.yml"}, got, "regular globs aren't recursive")
+
+	got, err = glob("t/data/nonexistent/**/*.yml")
+	assert.NoError(t, err, "No errors globbing nonexistent directories")
+	assert.Empty(t, got, "nothing found in nonexistent directories")
+}
+
+func Test_resolve_template(t *testing.T) {
+	templates := map[string]*Check{
+		"a":    &Check{ Use: "b", Every: 10 },
+		"b":    &Check{ Use: "a", Timeout: 5 },
+		"self": &Check{ Use: "self" },
+		"c":    &Check{ Use: "d", Env: map[string]string{"C": "c"} },
+		"d":    &Check{ Every: 20, Timeout: 4, Env: map[string]string{"C": "d", "D": "d"} },
+	}
+
+	_, err := resolve_template("a", templates, nil)
+	assert.EqualError(t, err, "Template loop detected: a -> b -> a", "template loops are detected")
+
+	_, err = resolve_template("self", templates, nil)
+	assert.EqualError(t, err, "Template loop detected: self -> self", "self-referencing templates are detected")
+
+	_, err = resolve_template("nope", templates, nil)
+	assert.EqualError(t, err, "Unknown template `nope`", "unknown templates throw an error")
+
+	got, err := resolve_template("c", templates, nil)
+	assert.NoError(t, err, "No errors resolving a valid template chain")
+	assert.Equal(t, &Check{ Use: "d", Every: 20, Timeout: 4, Env: map[string]string{"C": "c", "D": "d"} }, got,
+		"templates are flattened")
+	assert.Equal(t, map[string]string{"C": "c"}, templates["c"].Env, "resolving doesn't modify the original template")
+}
+
+func TestReloadConfig(t *testing.T) {
+	orig_osh := os_hostname
+	os_hostname = func () (string, error) {
+		return "test01.example.com", nil
+	}
+	defer func () { os_hostname = orig_osh }()
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	reload := func (file string) (*Config, error, string) {
+		r, w, _ := os.Pipe()
+		writer = w
+		got, err := ReloadConfig(file)
+		writer.Write([]byte("\nEOF"))
+		buffer := make([]byte, 1024)
+		n, _ := r.Read(buffer)
+		return got, err, string(buffer[0:n])
+	}
+	defer func () {
+		writer_lock.Lock()
+		defer writer_lock.Unlock()
+		writer = nil
+		send2bolo = nil
+	}()
+
+	cfg = nil // Reset cfg
+	orig, err := LoadConfig("t/data/basic.yml")
+	assert.NoError(t, err, "LoadConfig() on valid yaml doesn't return an error")
+	orig.Checks["first"].attempts = 2
+	running := &exec.Cmd{}
+	send2bolo = running
+
+	got, err, output := reload("t/data/bad.yml")
+	assert.EqualError(t, err, "YAML error: line 1: found unexpected end of stream", "unparseable configs fail to reload")
+	assert.True(t, orig == got, "the current config is kept when a reload fails")
+	assert.True(t, orig == cfg, "the current config is kept when a reload fails")
+	assert.True(t, running == send2bolo, "send_bolo is left alone when a reload fails")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:reload 2 config reload failed: YAML error"), output,
+		"failed reloads are reported to bolo")
+
+	got, err, output = reload("t/data/basic.yml")
+	assert.EqualError(t, err, "Invalid check config for second: Unspecified command", "configs with invalid checks fail to reload")
+	assert.True(t, orig == cfg, "the current config is kept when a check is invalid")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:reload 2 config reload failed: Invalid check config for second"),
+		output, "reloads with invalid checks are reported as failed")
+
+	got, err, output = reload("t/data/extended.yml")
+	if assert.Error(t, err, "configs with unparseable includes fail to reload") {
+		assert.Contains(t, err.Error(), "Could not parse config from \"t/data/bmad.d/bad.conf\"", "include parse errors are returned")
+	}
+	assert.True(t, orig == cfg, "the current config is kept when an include can't be parsed")
+
+	got, err, output = reload("t/data/unspawnable.yml")
+	if assert.Error(t, err, "configs whose send_bolo can't be spawned fail to reload") {
+		assert.Contains(t, err.Error(), "t/bin/send_bolo2", "send_bolo spawn errors are returned")
+	}
+	assert.True(t, orig == cfg, "the current config is kept when send_bolo can't be spawned")
+	assert.True(t, running == send2bolo, "send_bolo is left alone when the new send_bolo can't be spawned")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:reload 2 config reload failed: .*send_bolo2"), output,
+		"failed reloads are reported to bolo")
+
+	got, err, output = reload("t/data/plugins.yml")
+	assert.EqualError(t, err, "Invalid plugin config for broken: Unspecified command for plugin broken",
+		"configs with invalid plugins fail to reload")
+	assert.True(t, orig == cfg, "the current config is kept when a plugin is invalid")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:reload 2 config reload failed: Invalid plugin config for broken"),
+		output, "reloads with invalid plugins are reported as failed")
+
+	got, err, output = reload("t/data/reload.yml")
+	assert.NoError(t, err, "valid configs reload without error")
+	assert.False(t, orig == got, "a new config is swapped in")
+	assert.True(t, got == cfg, "a new config is swapped in")
+	assert.True(t, running == send2bolo, "send_bolo is left running if its command didn't change")
+	assert.Equal(t, 2, got.Checks["first"].attempts, "check state is carried over")
+	assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:bmad:reload 0 config reloaded successfully"), output,
+		"successful reloads are reported to bolo")
+
+	os.Mkdir("t/tmp", 0755)
+	r, w, _ := os.Pipe()
+	writer = w
+	got, err = ReloadConfig("t/data/resubmit.yml")
+	assert.NoError(t, err, "configs with a new send_bolo reload without error")
+	assert.True(t, got == cfg, "a new config is swapped in")
+	assert.False(t, running == send2bolo, "a new send_bolo was spawned")
+	assert.False(t, w == writer, "the new send_bolo is used for submissions")
+	buffer := make([]byte, 1024)
+	n, _ := r.Read(buffer)
+	assert.Equal(t, "", string(buffer[0:n]), "the old send_bolo is closed off before the reload is reported")
+	DisconnectFromBolo()
+}
+
 func Test_initialize_check(t *testing.T) {
 	orig_first_run := first_run
 	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
@@ -190,8 +689,8 @@ func Test_initialize_check(t *testing.T) {
 		Timeout:     45,
 		Env:         map[string]string{},
 		Run_as:      "",
-		Bulk:        "",
-		Report:      "",
+		Bulk:        TOGGLE_UNSET,
+		Report:      TOGGLE_UNSET,
 		Name:        "mycheck",
 		cmd_args:    []string{"test"},
 		next_run:    time.Unix(42,0),
@@ -274,15 +773,15 @@ func Test_initialize_check(t *testing.T) {
 	c.Retry_every = 30
 	c.Timeout     = 15
 	c.Retries     = 5
-	c.Bulk        = "true"
-	c.Report      = "true"
+	c.Bulk        = TOGGLE_ON
+	c.Report      = TOGGLE_ON
 	expect.Name        = "overridden"
 	expect.Every       = 60
 	expect.Retry_every = 30
 	expect.Timeout     = 15
 	expect.Retries     = 5
-	expect.Bulk        = "true"
-	expect.Report      = "true"
+	expect.Bulk        = TOGGLE_ON
+	expect.Report      = TOGGLE_ON
 	err = initialize_check("mycheck", &c, cfg)
 	assert.Nil(t, err, "No errors returned from initialize_check")
 	assert.Equal(t, expect, c, "check specific values are preferred over globals")
@@ -299,4 +798,275 @@ func Test_initialize_check(t *testing.T) {
 	err = initialize_check("mycheck", &c, cfg)
 	assert.EqualError(t, err, "Unable to parse command ``should error`: invalid command line string",
 		"shell words parsing failures propagate properly")
+
+	c = Check{ Command: "test", Report: TOGGLE_ON }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "report is only supported for bulk checks (use exit_state for non-bulk checks)",
+		"report on a non-bulk check throws an error")
+
+	c = Check{ Command: "test", Bulk: TOGGLE_OFF }
+	cfg.Bulk   = TOGGLE_ON
+	cfg.Report = TOGGLE_ON
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, TOGGLE_OFF, c.Bulk, "explicit false overrides a global bulk of true")
+	assert.Equal(t, TOGGLE_ON, c.Report, "report is inherited from the global defaults")
+
+	c = Check{ Command: "test" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, TOGGLE_ON, c.Bulk, "unset bulk is inherited from the global defaults")
+
+	c = Check{ Command: "test", Bulk: toggle_invalid }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid boolean value for bulk", "unparseable bulk values throw an error")
+
+	c = Check{ Command: "test", Cwd: "/opt/collectors", Umask: "027", Stdin: "${default:BMAD_TEST_STDIN:input}" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, "/opt/collectors", c.Cwd, "cwd is kept as-is")
+	assert.Equal(t, "027", c.Umask, "umask is kept as-is")
+	assert.Equal(t, "input", c.Stdin, "stdin is interpolated")
+
+	c = Check{ Command: "test", Cwd: "opt/collectors" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid cwd `opt/collectors`, expected an absolute path", "relative cwds throw an error")
+
+	c = Check{ Command: "test", Umask: "999" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid umask `999`, expected an octal value between 000 and 777", "non-octal umasks throw an error")
+
+	nice := 10
+	cfg.Limits = Limits{ Open_files: 64, Cpu_time: 30, Nice: &nice }
+	c = Check{ Command: "test", Limits: Limits{ Open_files: 128 } }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, Limits{ Open_files: 128, Cpu_time: 30, Nice: &nice }, c.Limits,
+		"limits are inherited individually from the global defaults")
+
+	c = Check{ Command: "test", Every: 60, Timeout: 120, Allow_long_timeout: TOGGLE_ON }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, int64(120), c.Timeout, "checks can opt in to timeouts longer than retry_every")
+
+	c = Check{ Command: "test", Every: 60, Timeout: 120, Allow_long_timeout: TOGGLE_OFF }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, int64(59), c.Timeout, "timeouts are limited to retry_every by default")
+
+	c = Check{ Command: "test", Timeout_signal: "SIGSTOP" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid timeout_signal `SIGSTOP`", "unknown timeout signals throw an error")
+
+	kill_after := int64(-1)
+	c = Check{ Command: "test", Kill_after: &kill_after }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid kill_after -1, expected 0 or more seconds", "negative kill_after throws an error")
+
+	checks := map[string]*Check{}
+	err = unmarshal_config("kill_after.yml", []byte("check: { command: test, kill_after: 0 }"), &checks)
+	assert.NoError(t, err, "No errors parsing kill_after")
+	if assert.NotNil(t, checks["check"].Kill_after, "an explicit kill_after of 0 is set") {
+		assert.Equal(t, int64(0), *checks["check"].Kill_after, "an explicit kill_after of 0 is kept")
+	}
+
+	c = Check{ Command: "test", Report_timeout: toggle_invalid }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid boolean value for report_timeout", "unparseable report_timeout values throw an error")
+
+	c = Check{ Command: "test", Bulk: TOGGLE_OFF, Stream: TOGGLE_ON }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "stream is only supported for bulk checks", "stream on non-bulk checks throws an error")
+
+	c = Check{ Command: "test", Bulk: TOGGLE_ON, Stream: toggle_invalid }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid boolean value for stream", "unparseable stream values throw an error")
+
+	c = Check{ Command: "test", Every: 60, Timeout: 120, Bulk: TOGGLE_OFF, Mode: "persistent" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, int64(120), c.Timeout, "persistent checks are exempt from timeout limits")
+	assert.Equal(t, TOGGLE_ON, c.Bulk, "persistent checks are bulk checks")
+	assert.Equal(t, TOGGLE_ON, c.Stream, "persistent checks stream their output")
+	assert.Equal(t, time.Time{}, c.next_run, "persistent checks are started right away")
+
+	c = Check{ Command: "test", Mode: "sometimes" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid mode `sometimes`, expected scheduled or persistent", "unknown modes throw an error")
+
+	c = Check{ Command: "test", Exit_codes: map[string]string{"0": "OK", "4": "warning", "255": "2"}, Signal_rc: "critical" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+
+	c = Check{ Command: "test", Exit_codes: map[string]string{"256": "OK"} }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid exit code `256` in exit_codes, expected a number between 0 and 255",
+		"out of range exit codes throw an error")
+
+	c = Check{ Command: "test", Exit_codes: map[string]string{"4": "BAD"} }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid state `BAD` for exit code 4, expected OK, WARNING, CRITICAL, or UNKNOWN",
+		"unknown states in exit_codes throw an error")
+
+	c = Check{ Command: "test", Signal_rc: "5" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid signal_rc `5`, expected OK, WARNING, CRITICAL, or UNKNOWN",
+		"unknown signal_rc states throw an error")
+
+	c = Check{ Command: "test", Bulk: TOGGLE_ON, Exit_state: TOGGLE_ON }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "exit_state is only supported for non-bulk checks (use report for bulk checks)",
+		"exit_state on a bulk check throws an error")
+
+	c = Check{ Command: "test", Exit_state: toggle_invalid }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid boolean value for exit_state", "unparseable exit_state values throw an error")
+
+	cfg.Exit_state = TOGGLE_ON
+	c = Check{ Command: "test", Bulk: TOGGLE_OFF }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, TOGGLE_ON, c.Exit_state, "exit_state is inherited from the global default")
+	c = Check{ Command: "test", Bulk: TOGGLE_ON }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "bulk checks don't fail to load when exit_state is on by default")
+	cfg.Exit_state = TOGGLE_UNSET
+
+	c = Check{ Builtin: "process", Params: map[string]string{"name": "nginx", "min": "2"} }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check for builtin checks")
+	assert.Nil(t, c.cmd_args, "builtin checks have no command to run")
+
+	c = Check{ Command: "test", Builtin: "load" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Checks cannot have both a command and a builtin", "commands and builtins are exclusive")
+
+	c = Check{ Builtin: "uptime" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Unknown builtin `uptime`, expected one of: disk, dns, file, http, load, memory, process, tcp",
+		"unknown builtins throw an error")
+
+	c = Check{ Builtin: "process", Params: map[string]string{"name": "nginx", "min": "lots"} }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid min `lots`, expected a number", "builtin params are validated")
+
+	c = Check{ Builtin: "load", Mode: MODE_PERSISTENT }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "builtin checks cannot be persistent", "builtins can't be persistent")
+
+	cfg.Plugins = map[string]*Plugin{"python": &Plugin{ Command: "python-collectors" }}
+	c = Check{ Plugin: "python", Params: map[string]string{"db": "main"} }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check for plugin checks")
+	assert.Nil(t, c.cmd_args, "plugin checks have no command to run")
+
+	c = Check{ Plugin: "ruby" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Unknown plugin `ruby`", "checks using undefined plugins throw an error")
+
+	c = Check{ Command: "test", Plugin: "python" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Checks cannot have both a command and a plugin", "commands and plugins are exclusive")
+
+	c = Check{ Builtin: "load", Plugin: "python" }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Checks cannot have both a builtin and a plugin", "builtins and plugins are exclusive")
+
+	c = Check{ Plugin: "python", Mode: MODE_PERSISTENT }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "plugin checks cannot be persistent", "plugin checks can't be persistent")
+	cfg.Plugins = nil
+
+	cfg.Max_output = 65536
+	c = Check{ Command: "test", Max_stderr: 1024 }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.Nil(t, err, "No errors returned from initialize_check")
+	assert.Equal(t, int64(65536), c.Max_output, "max_output is inherited from the global default")
+	assert.Equal(t, int64(1024), c.Max_stderr, "max_stderr is kept as-is")
+	cfg.Max_output = 0
+
+	c = Check{ Command: "test", Max_output: -1 }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid max_output -1, expected a positive number of bytes", "negative max_output throws an error")
+
+	c = Check{ Command: "test", Max_stderr: -1 }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid max_stderr -1, expected a positive number of bytes", "negative max_stderr throws an error")
+
+	c = Check{ Command: "test", Limits: Limits{ Ionice: "sometimes" } }
+	err = initialize_check("mycheck", &c, cfg)
+	assert.EqualError(t, err, "Invalid ionice `sometimes`, expected idle, best-effort[:level], or realtime[:level]",
+		"invalid limits throw an error")
+}
+
+func TestLoadConfigPlugins(t *testing.T) {
+	cfg = nil // Reset cfg
+	got, err := LoadConfig("t/data/plugins.yml")
+	assert.Nil(t, err, "LoadConfig() on valid yaml doesn't return an error")
+
+	assert.Equal(t, []string{"python"}, plugin_names(got), "invalid plugins are skipped")
+	plugin := got.Plugins["python"]
+	assert.Equal(t, "python", plugin.name, "plugins are named after their key")
+	assert.Equal(t, []string{"/usr/lib/bolo/plugins/python-collectors", "--workers", "2"}, plugin.cmd_args,
+		"plugin commands are parsed")
+	assert.Equal(t, map[string]string{"PATH": "/bin", "PYTHONPATH": "/usr/lib/bolo/python"}, plugin.Env,
+		"plugin env inherits the global env")
+
+	assert.Equal(t, "python", got.Checks["pg_replication"].Plugin, "checks can use plugins")
+	assert.Equal(t, map[string]string{"database": "main"}, got.Checks["pg_replication"].Params,
+		"params for plugin checks are loaded")
+	assert.Nil(t, got.Checks["uses_broken"], "checks using invalid plugins are skipped")
+}
+
+func plugin_names(c *Config) []string {
+	var names []string
+	for name := range c.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestExitCodes(t *testing.T) {
+	for _, file := range []string{"exit_codes.yml", "exit_codes.json"} {
+		checks := map[string]*Check{}
+		var source string
+		if file == "exit_codes.yml" {
+			source = "check: { exit_codes: { 0: OK, 4: WARNING, 255: CRITICAL } }"
+		} else {
+			source = `{ "check": { "exit_codes": { "0": "OK", "4": "WARNING", "255": "CRITICAL" } } }`
+		}
+		err := unmarshal_config(file, []byte(source), &checks)
+		assert.NoError(t, err, "No errors parsing exit_codes from %s", file)
+		assert.Equal(t, map[string]string{"0": "OK", "4": "WARNING", "255": "CRITICAL"}, checks["check"].Exit_codes,
+			"exit_codes are parsed from %s", file)
+	}
+}
+
+func Test_Toggle(t *testing.T) {
+	checks := map[string]*Check{}
+	err := goyaml.Unmarshal([]byte(`
+yaml_true:    { bulk: yes,    report: true }
+yaml_false:   { bulk: false,  report: no }
+string_true:  { bulk: "true", report: "True" }
+string_false: { bulk: "false" }
+unset:        { command: test }
+bogus:        { bulk: maybe }
+`), &checks)
+	assert.NoError(t, err, "No errors parsing toggles")
+
+	assert.Equal(t, TOGGLE_ON,  checks["yaml_true"].Bulk,      "YAML booleans are understood")
+	assert.Equal(t, TOGGLE_ON,  checks["yaml_true"].Report,    "YAML booleans are understood")
+	assert.Equal(t, TOGGLE_OFF, checks["yaml_false"].Bulk,     "YAML false is understood")
+	assert.Equal(t, TOGGLE_OFF, checks["yaml_false"].Report,   "YAML 'no' is understood")
+	assert.Equal(t, TOGGLE_ON,  checks["string_true"].Bulk,    "legacy \"true\" strings are understood")
+	assert.Equal(t, TOGGLE_ON,  checks["string_true"].Report,  "string booleans are case insensitive")
+	assert.Equal(t, TOGGLE_OFF, checks["string_false"].Bulk,   "legacy \"false\" strings are understood")
+	assert.Equal(t, TOGGLE_UNSET, checks["string_false"].Report, "missing values are unset")
+	assert.Equal(t, TOGGLE_UNSET, checks["unset"].Bulk,        "missing values are unset")
+	assert.Equal(t, toggle_invalid, checks["bogus"].Bulk,      "unparseable values are flagged")
+
+	assert.True(t,  TOGGLE_ON.On(),    "TOGGLE_ON is on")
+	assert.False(t, TOGGLE_OFF.On(),   "TOGGLE_OFF is off")
+	assert.False(t, TOGGLE_UNSET.On(), "TOGGLE_UNSET is off")
 }
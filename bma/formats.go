@@ -0,0 +1,82 @@
+package bma
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "launchpad.net/goyaml"
+import "path/filepath"
+import "strings"
+import "github.com/BurntSushi/toml"
+
+// Returns the format of a config file, based on its extension.
+// Anything that isn't JSON or TOML is treated as YAML (.yml,
+// .yaml, and the .conf files found in include_dir).
+func config_format(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return "yaml"
+}
+
+// Parses source (the contents of file) into out, using the format
+// indicated by the file's extension. JSON and TOML configs are converted
+// to YAML before being unmarshaled, so that every format goes through
+// the same parsing and validation logic (Toggles, defaults, etc.)
+func unmarshal_config(file string, source []byte, out interface{}) error {
+	var data interface{}
+	switch config_format(file) {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(source))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return errors.New(fmt.Sprintf("JSON error: %s", err.Error()))
+		}
+		data = json_numbers(data)
+
+	case "toml":
+		var doc map[string]interface{}
+		if _, err := toml.Decode(string(source), &doc); err != nil {
+			return errors.New(fmt.Sprintf("TOML error: %s", err.Error()))
+		}
+		data = doc
+
+	default:
+		return goyaml.Unmarshal(source, out)
+	}
+
+	if data == nil {
+		return nil
+	}
+	converted, err := goyaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return goyaml.Unmarshal(converted, out)
+}
+
+// Converts json.Numbers in decoded JSON data to int64s where possible,
+// and float64s otherwise, so integers don't lose precision, or end
+// up formatted in scientific notation
+func json_numbers(data interface{}) interface{} {
+	switch v := data.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = json_numbers(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = json_numbers(val)
+		}
+	}
+	return data
+}
@@ -0,0 +1,111 @@
+package bma
+
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "strconv"
+import "strings"
+
+// Matches ${...} references in config values, as well as the
+// $${ escape sequence for passing a literal ${ through to the check
+var reference = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// Matches valid environment variable names
+var env_name = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Text used in place of secret values when logging
+const MASK string = "********"
+
+// Resolves any references in value, and returns the interpolated result,
+// along with any secret values that were interpolated into it. Supported
+// references are:
+//
+//	${NAME}                 value of the NAME environment variable (which must be set)
+//	${default:NAME:value}   value of the NAME environment variable, or 'value' if unset
+//	${file:/path/to/file}   contents of the file, minus trailing newlines (treated as a secret)
+//
+// Use $${ to include a literal ${ in the value.
+func interpolate(value string) (string, []string, error) {
+	var secrets []string
+	var err error
+	result := reference.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		if ref == "$${" {
+			return "${"
+		}
+		var resolved string
+		var secret bool
+		resolved, secret, err = resolve_reference(ref[2 : len(ref)-1])
+		if secret && resolved != "" {
+			secrets = append(secrets, resolved)
+		}
+		return resolved
+	})
+	if err != nil {
+		return value, nil, err
+	}
+	return result, secrets, nil
+}
+
+// Resolves a single reference (without the surrounding ${}), returning
+// its value, and whether or not that value should be treated as a secret
+func resolve_reference(ref string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", true, errors.New(fmt.Sprintf("Unable to read ${%s}: %s", ref, err.Error()))
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, nil
+
+	case strings.HasPrefix(ref, "default:"):
+		parts := strings.SplitN(strings.TrimPrefix(ref, "default:"), ":", 2)
+		if len(parts) != 2 || !env_name.MatchString(parts[0]) {
+			return "", false, errors.New(fmt.Sprintf("Invalid reference ${%s}, expected ${default:NAME:value}", ref))
+		}
+		if val, ok := os.LookupEnv(parts[0]); ok {
+			return val, false, nil
+		}
+		return parts[1], false, nil
+	}
+
+	if !env_name.MatchString(ref) {
+		return "", false, errors.New(fmt.Sprintf("Invalid reference ${%s}", ref))
+	}
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", false, errors.New(fmt.Sprintf("Environment variable %s is not set (referenced via ${%s})", ref, ref))
+	}
+	return val, false, nil
+}
+
+// Interpolates a config value for the Check, keeping track of
+// any secrets used, so they can be masked when logging the Check
+func (self *Check) interpolate(value string) (string, error) {
+	result, secrets, err := interpolate(value)
+	if err != nil {
+		return value, err
+	}
+	self.secrets = append(self.secrets, secrets...)
+	return result, nil
+}
+
+// Replaces any secret values found in s with MASK, so that s
+// can be logged safely. Handles both raw and Go-quoted (%#v)
+// representations of the secrets.
+func mask_secrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.Replace(s, secret, MASK, -1)
+		quoted := strconv.Quote(secret)
+		s = strings.Replace(s, quoted[1:len(quoted)-1], MASK, -1)
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "fmt"
+import "os"
+import "time"
+
+func Test_interpolate(t *testing.T) {
+	os.Setenv("BMAD_TEST_VAR", "value")
+	defer os.Unsetenv("BMAD_TEST_VAR")
+	os.Unsetenv("BMAD_TEST_UNSET")
+
+	got, secrets, err := interpolate("plain string")
+	assert.NoError(t, err, "No errors on strings without references")
+	assert.Equal(t, "plain string", got, "strings without references are unchanged")
+	assert.Nil(t, secrets, "no secrets found in plain strings")
+
+	got, secrets, err = interpolate("--opt=${BMAD_TEST_VAR} ${BMAD_TEST_VAR}")
+	assert.NoError(t, err, "No errors interpolating set environment variables")
+	assert.Equal(t, "--opt=value value", got, "environment variables are interpolated")
+	assert.Nil(t, secrets, "environment variables are not secret")
+
+	_, _, err = interpolate("${BMAD_TEST_UNSET}")
+	assert.EqualError(t, err, "Environment variable BMAD_TEST_UNSET is not set (referenced via ${BMAD_TEST_UNSET})",
+		"unset environment variables throw an error")
+
+	got, _, err = interpolate("${default:BMAD_TEST_UNSET:fallback:value}")
+	assert.NoError(t, err, "No errors interpolating defaults")
+	assert.Equal(t, "fallback:value", got, "defaults are used for unset environment variables")
+
+	got, _, err = interpolate("${default:BMAD_TEST_VAR:fallback}")
+	assert.NoError(t, err, "No errors interpolating defaults")
+	assert.Equal(t, "value", got, "set environment variables take precedence over defaults")
+
+	_, _, err = interpolate("${default:BMAD_TEST_VAR}")
+	assert.EqualError(t, err, "Invalid reference ${default:BMAD_TEST_VAR}, expected ${default:NAME:value}",
+		"defaults without a value throw an error")
+
+	got, secrets, err = interpolate("pw=${file:t/data/secrets/db_password}")
+	assert.NoError(t, err, "No errors interpolating files")
+	assert.Equal(t, "pw=s3cr3t \"pw\"", got, "file contents are interpolated, without trailing newlines")
+	assert.Equal(t, []string{"s3cr3t \"pw\""}, secrets, "file contents are secret")
+
+	_, _, err = interpolate("${file:t/data/secrets/nonexistent}")
+	assert.EqualError(t, err, "Unable to read ${file:t/data/secrets/nonexistent}: open t/data/secrets/nonexistent: no such file or directory",
+		"unreadable files throw an error")
+
+	_, _, err = interpolate("${not a var}")
+	assert.EqualError(t, err, "Invalid reference ${not a var}", "invalid references throw an error")
+
+	got, _, err = interpolate("echo $${BMAD_TEST_VAR} $$ $HOME")
+	assert.NoError(t, err, "No errors on escaped references")
+	assert.Equal(t, "echo ${BMAD_TEST_VAR} $$ $HOME", got, "escaped references are passed through literally")
+}
+
+func Test_mask_secrets(t *testing.T) {
+	assert.Equal(t, "user=bob pw=********", mask_secrets("user=bob pw=hunter2", []string{"hunter2"}),
+		"secrets are masked")
+	assert.Equal(t, `[]string{"--pw", "********"}`, mask_secrets(`[]string{"--pw", "a \"quoted\" pw"}`, []string{`a "quoted" pw`}),
+		"quoted secrets are masked")
+	assert.Equal(t, "nothing to see", mask_secrets("nothing to see", []string{""}), "empty secrets are ignored")
+}
+
+func TestLoadConfigInterpolation(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	os.Setenv("BMAD_TEST_ENDPOINT", "tcp://bolo:2999")
+	os.Setenv("BMAD_TEST_DB_USER", "monitor")
+	defer os.Unsetenv("BMAD_TEST_ENDPOINT")
+	defer os.Unsetenv("BMAD_TEST_DB_USER")
+	os.Unsetenv("BMAD_TEST_DB_HOST")
+	os.Unsetenv("BMAD_TEST_UNSET")
+
+	cfg = nil // Reset cfg
+	got, err := LoadConfig("t/data/interpolate.yml")
+	assert.NoError(t, err, "LoadConfig() on valid yaml doesn't return an error")
+	assert.Equal(t, "t/bin/send_bolo -e tcp://bolo:2999", got.Send_bolo, "send_bolo is interpolated")
+
+	check := got.Checks["db"]
+	if assert.NotNil(t, check, "check with valid references is loaded") {
+		assert.Equal(t, []string{"check_db", "--user", "monitor", "--password", "s3cr3t \"pw\"", "--literal", "${HOME}"},
+			check.cmd_args, "command arguments are interpolated")
+		assert.Equal(t, map[string]string{"DB_HOST": "localhost", "DB_PASSWORD": "s3cr3t \"pw\""}, check.Env,
+			"env values are interpolated, including global env values")
+		assert.NotContains(t, check.Command, "s3cr3t", "the configured command keeps the reference, not the secret")
+		assert.Contains(t, mask_secrets(fmt.Sprintf("%#v", check), check.secrets), MASK, "secrets are masked in debug output")
+		assert.NotContains(t, mask_secrets(fmt.Sprintf("%#v", check), check.secrets), "s3cr3t", "secrets are masked in debug output")
+	}
+
+	_, exists := got.Checks["unset"]
+	assert.False(t, exists, "checks referencing unset environment variables are skipped")
+
+	cfg = nil // Reset cfg
+	os.Unsetenv("BMAD_TEST_ENDPOINT")
+	_, err = LoadConfig("t/data/interpolate.yml")
+	assert.EqualError(t, err, "Invalid send_bolo: Environment variable BMAD_TEST_ENDPOINT is not set (referenced via ${BMAD_TEST_ENDPOINT})",
+		"unresolvable send_bolo references fail the config load")
+}
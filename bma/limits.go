@@ -0,0 +1,127 @@
+package bma
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "os"
+import "regexp"
+import "runtime"
+import "strconv"
+import "syscall"
+
+// Environment variable used to pass resource limits (and umask) from
+// bmad to the copy of itself that applies them before exec'ing a check
+const LIMITS_ENV string = "BMAD_LIMITS"
+
+// Limits describe the resources available to a Check's process. Zero
+// values (and nil, for Nice) leave the corresponding limit unset, so
+// that it can be inherited from templates, and the global defaults.
+type Limits struct {
+	Address_space int64  `json:"address_space"` // Maximum virtual memory size (in megabytes)
+	Cpu_time      int64  `json:"cpu_time"`      // Maximum CPU time (in seconds)
+	Open_files    int64  `json:"open_files"`    // Maximum number of open file descriptors
+	Processes     int64  `json:"processes"`     // Maximum number of processes for the user running the Check
+	Nice          *int   `json:"nice"`          // Scheduling priority (-20 to 19)
+	Ionice        string `json:"ionice"`        // I/O scheduling class and level (idle, best-effort[:0-7], or realtime[:0-7])
+}
+
+// Settings passed along in BMAD_LIMITS, to be applied
+// to a check's process before exec'ing its command
+type shim_settings struct {
+	Limits Limits `json:"limits"`
+	Umask  *int   `json:"umask"`
+}
+
+// Matches ionice settings, capturing the class and (optional) level
+var ionice_setting = regexp.MustCompile(`^(idle|best-effort|realtime)(?::([0-7]))?$`)
+
+// Returns true if any of the limits have been set
+func (l Limits) set() bool {
+	return l.Address_space != 0 || l.Cpu_time != 0 || l.Open_files != 0 ||
+		l.Processes != 0 || l.Nice != nil || l.Ionice != ""
+}
+
+// Validates the limits, returning an error describing the first problem found
+func (l Limits) validate() error {
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{
+		{"address_space", l.Address_space},
+		{"cpu_time", l.Cpu_time},
+		{"open_files", l.Open_files},
+		{"processes", l.Processes},
+	} {
+		if limit.value < 0 {
+			return errors.New(fmt.Sprintf("Invalid %s limit %d, expected a positive value", limit.name, limit.value))
+		}
+	}
+	if l.Nice != nil && (*l.Nice < -20 || *l.Nice > 19) {
+		return errors.New(fmt.Sprintf("Invalid nice value %d, expected a value between -20 and 19", *l.Nice))
+	}
+	if l.Ionice != "" && !ionice_setting.MatchString(l.Ionice) {
+		return errors.New(fmt.Sprintf("Invalid ionice `%s`, expected idle, best-effort[:level], or realtime[:level]", l.Ionice))
+	}
+	return nil
+}
+
+// Returns the ioprio value for the ionice setting of the limits
+// (class in the upper bits, level in the lower bits)
+func (l Limits) ioprio() int {
+	m := ionice_setting.FindStringSubmatch(l.Ionice)
+	if m == nil {
+		return 0
+	}
+	level, _ := strconv.Atoi(m[2])
+	switch m[1] {
+	case "realtime":
+		return 1<<13 | level
+	case "best-effort":
+		return 2<<13 | level
+	}
+	return 3 << 13
+}
+
+// Function-variable for finding the bmad executable, which is used to
+// apply resource limits to checks (used for mocking during tests)
+var shim_executable = os.Executable
+
+// Go provides no way to run code between fork() and exec(), so checks
+// with resource limits (or a umask, which is process-wide, and can't be
+// changed in bmad without affecting its other goroutines) are spawned via
+// bmad itself, with the settings passed along in the BMAD_LIMITS environment
+// variable. bmad calls this before doing anything else. If BMAD_LIMITS is
+// set, the settings are applied, and the check's command (the first argument,
+// followed by its argv) is exec'd in place of bmad. Otherwise, this returns
+// immediately.
+//
+// If the limits can't be applied, the failure is reported on stderr,
+// and the check exits UNKNOWN.
+func ExecWithLimits() {
+	encoded, ok := os.LookupEnv(LIMITS_ENV)
+	if !ok {
+		return
+	}
+	os.Unsetenv(LIMITS_ENV)
+
+	// priorities are per-thread on Linux, so they must be set
+	// on the same thread that execs the check
+	runtime.LockOSThread()
+
+	var settings shim_settings
+	err := json.Unmarshal([]byte(encoded), &settings)
+	if err == nil && len(os.Args) < 3 {
+		err = errors.New("no command specified")
+	}
+	if err == nil && settings.Umask != nil {
+		syscall.Umask(*settings.Umask)
+	}
+	if err == nil && settings.Limits.set() {
+		err = apply_limits(settings.Limits)
+	}
+	if err == nil {
+		err = syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "bmad: unable to apply resource limits: %s\n", err.Error())
+	os.Exit(UNKNOWN)
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "errors"
+import "fmt"
+import "syscall"
+
+// RLIMIT_NPROC isn't provided by the syscall package
+const rlimit_nproc int = 6
+
+// ioprio_set(2) target, for the calling thread
+const ioprio_who_process int = 1
+
+// Applies limits to the current process (see ExecWithLimits)
+func apply_limits(l Limits) error {
+	rlimits := []struct {
+		name     string
+		resource int
+		cur      uint64
+		max      uint64
+	}{
+		{"address_space", syscall.RLIMIT_AS, uint64(l.Address_space) << 20, uint64(l.Address_space) << 20},
+		// give checks a second to handle SIGXCPU before being killed
+		{"cpu_time", syscall.RLIMIT_CPU, uint64(l.Cpu_time), uint64(l.Cpu_time) + 1},
+		{"open_files", syscall.RLIMIT_NOFILE, uint64(l.Open_files), uint64(l.Open_files)},
+		{"processes", rlimit_nproc, uint64(l.Processes), uint64(l.Processes)},
+	}
+	for _, r := range rlimits {
+		if r.cur == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: r.cur, Max: r.max}); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", r.name, err.Error()))
+		}
+	}
+
+	if l.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *l.Nice); err != nil {
+			return errors.New(fmt.Sprintf("nice: %s", err.Error()))
+		}
+	}
+	if l.Ionice != "" {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, uintptr(ioprio_who_process), 0, uintptr(l.ioprio()))
+		if errno != 0 {
+			return errors.New(fmt.Sprintf("ionice: %s", errno.Error()))
+		}
+	}
+	return nil
+}
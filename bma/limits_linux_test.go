@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "fmt"
+import "os"
+import "syscall"
+
+func Test_limits_applied(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Couldn't get working directory of tests: %s", err.Error())
+	}
+	cfg = &Config{
+		Host: "test01.example.com",
+	}
+	nice, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Fatalf("Couldn't get priority of tests: %s", err.Error())
+	}
+	// Getpriority returns 20 - nice on Linux
+	want_nice := 20 - nice + 5
+	if want_nice > 19 {
+		want_nice = 19
+	}
+
+	check := Check{
+		cmd_args: []string{pwd + "/t/bin/test_limits"},
+		Name:     "test_limits",
+		Every:    300,
+		Timeout:  20,
+		Limits:   Limits{Address_space: 1024, Cpu_time: 30, Open_files: 64, Processes: 4096, Nice: &want_nice,
+			Ionice: "best-effort:7"},
+	}
+	check.test(t, fmt.Sprintf("address_space 1048576\ncpu_time 30\nopen_files 64\nprocesses 4096\nnice %d\n", want_nice),
+		0, "check with resource limits")
+
+	var rlimit syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit)
+	assert.NotEqual(t, uint64(64), rlimit.Cur, "bmad's own limits are unaffected")
+
+	// more than the kernel allows (fs.nr_open), even for root
+	check.Limits = Limits{Open_files: 1 << 40}
+	check.test(t, "", 3, "check with unapplyable resource limits")
+	assert.Equal(t, "bmad: unable to apply resource limits: open_files: operation not permitted\n", check.err_msg,
+		"failure to apply resource limits is reported on stderr")
+}
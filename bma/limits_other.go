@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package bma
+
+import "errors"
+
+// Resource limits are only supported on Linux
+func apply_limits(l Limits) error {
+	return errors.New("resource limits are only supported on Linux")
+}
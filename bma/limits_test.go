@@ -0,0 +1,36 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "os"
+
+// Checks with resource limits are spawned via the current executable,
+// so the test binary needs to be able to act as the limits shim (and
+// as a plugin, for the plugin tests)
+func TestMain(m *testing.M) {
+	ExecWithLimits()
+	serve_test_plugin()
+	os.Exit(m.Run())
+}
+
+func Test_limits(t *testing.T) {
+	nice := 10
+	assert.False(t, Limits{}.set(), "empty limits are not set")
+	assert.True(t, Limits{Nice: &nice}.set(), "limits with a nice value are set")
+	assert.True(t, Limits{Open_files: 64}.set(), "limits with an rlimit are set")
+
+	assert.NoError(t, Limits{Address_space: 512, Cpu_time: 30, Open_files: 64, Processes: 10, Nice: &nice,
+		Ionice: "best-effort:7"}.validate(), "valid limits validate")
+	assert.EqualError(t, Limits{Open_files: -1}.validate(),
+		"Invalid open_files limit -1, expected a positive value", "negative limits are invalid")
+	nice = 20
+	assert.EqualError(t, Limits{Nice: &nice}.validate(),
+		"Invalid nice value 20, expected a value between -20 and 19", "out of range nice values are invalid")
+	assert.EqualError(t, Limits{Ionice: "best-effort:8"}.validate(),
+		"Invalid ionice `best-effort:8`, expected idle, best-effort[:level], or realtime[:level]",
+		"out of range ionice levels are invalid")
+
+	assert.Equal(t, 3 << 13,     Limits{Ionice: "idle"}.ioprio(),          "idle ionice class")
+	assert.Equal(t, 2 << 13 | 7, Limits{Ionice: "best-effort:7"}.ioprio(), "best-effort ionice class and level")
+	assert.Equal(t, 1 << 13,     Limits{Ionice: "realtime"}.ioprio(),      "realtime ionice class")
+}
@@ -0,0 +1,394 @@
+package bma
+
+import "bufio"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "github.com/starkandwayne/goutils/log"
+import "io"
+import "os/exec"
+import shellwords "github.com/mattn/go-shellwords"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+// Plugins are long-lived child processes that run Checks on bmad's behalf,
+// so that collectors with expensive startup costs (interpreters importing
+// heavy libraries, connection pools, etc.) only pay them once. bmad launches
+// each plugin the first time one of its Checks is run, and talks to it over
+// its standard input and output, one JSON-RPC 2.0 message per line. Each run
+// of a Check is a request like:
+//
+//	{"jsonrpc":"2.0","id":1,"method":"run","params":{"check":"name","params":{},"timeout":45}}
+//
+// to which the plugin replies (in any order, if it handles requests
+// concurrently) with either a result, or an error:
+//
+//	{"jsonrpc":"2.0","id":1,"result":{"rc":0,"output":"STATE ...\n"}}
+//	{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"database unreachable"}}
+//
+// The rc and output of a result are treated like the exit code and standard
+// output of a Check's command, and the message of an error like its standard
+// error (with an UNKNOWN rc). Anything the plugin writes to its standard error
+// is logged. If a plugin exits, its outstanding requests fail, and it is
+// relaunched the next time one of its Checks is run.
+type Plugin struct {
+	Command    string            // Command to launch the plugin
+	Env        map[string]string // Environment variables to set for the plugin
+	Kill_after *int64            // Time to wait after sending SIGTERM when stopping the plugin, before sending SIGKILL (in seconds, defaults to 2)
+
+	name     string
+	cmd_args []string
+	secrets  []string
+	lock     sync.Mutex
+	process  *plugin_process
+}
+
+// Maximum number of requests that can be waiting to be written to a
+// plugin, before further runs of its checks fail
+const PLUGIN_QUEUE int = 1024
+
+// State of a running plugin process, and the requests it has yet to answer
+type plugin_process struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	requests chan queued_request // requests waiting to be written to the plugin's standard input
+	next_id  int64
+	pending  map[int64]chan builtin_result
+	exited   bool
+	done     chan bool // closed once the plugin has exited
+}
+
+// A request waiting to be written to a plugin
+type queued_request struct {
+	id   int64
+	line []byte
+}
+
+// Requests sent to plugins
+type plugin_request struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Id      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  plugin_params `json:"params"`
+}
+
+type plugin_params struct {
+	Check   string            `json:"check"`
+	Params  map[string]string `json:"params"`
+	Timeout int64             `json:"timeout"`
+}
+
+// Responses received from plugins
+type plugin_response struct {
+	Id     int64 `json:"id"`
+	Result *struct {
+		Rc     int    `json:"rc"`
+		Output string `json:"output"`
+	} `json:"result"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Validates a plugin's configuration, parsing its command, and interpolating
+// its command and environment (which inherits the global env of defaults)
+func initialize_plugin(name string, plugin *Plugin, defaults *Config) error {
+	plugin.name = name
+	plugin.secrets = nil
+	if plugin.Command == "" {
+		return errors.New(fmt.Sprintf("Unspecified command for plugin %s", name))
+	}
+	args, err := shellwords.Parse(plugin.Command)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to parse command `%s` for plugin %s: %s", plugin.Command, name, err.Error()))
+	}
+	for i, arg := range args {
+		var secrets []string
+		if args[i], secrets, err = interpolate(arg); err != nil {
+			return errors.New(fmt.Sprintf("Invalid command for plugin %s: %s", name, err.Error()))
+		}
+		plugin.secrets = append(plugin.secrets, secrets...)
+	}
+	plugin.cmd_args = args
+
+	if plugin.Kill_after != nil && *plugin.Kill_after < 0 {
+		return errors.New(fmt.Sprintf("Invalid kill_after %d for plugin %s, expected 0 or more seconds", *plugin.Kill_after, name))
+	}
+
+	if plugin.Env == nil {
+		plugin.Env = map[string]string{}
+	}
+	for key, val := range defaults.Env {
+		if _, ok := plugin.Env[key]; !ok {
+			plugin.Env[key] = val
+		}
+	}
+	for key, val := range plugin.Env {
+		var secrets []string
+		if plugin.Env[key], secrets, err = interpolate(val); err != nil {
+			return errors.New(fmt.Sprintf("Invalid env for plugin %s: %s", name, err.Error()))
+		}
+		plugin.secrets = append(plugin.secrets, secrets...)
+	}
+	return nil
+}
+
+// Returns true if two plugins would be launched the same way, so that
+// a running plugin can be kept across config reloads
+func (self *Plugin) same(other *Plugin) bool {
+	if strings.Join(self.cmd_args, "\x00") != strings.Join(other.cmd_args, "\x00") || len(self.Env) != len(other.Env) {
+		return false
+	}
+	for k, v := range self.Env {
+		if other.Env[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Launches the plugin process, along with goroutines to write its
+// requests, read its responses, log its standard error, and notice
+// when it exits
+func (self *Plugin) start() error {
+	process := exec.Command(self.cmd_args[0], self.cmd_args[1:]...)
+	for k, v := range self.Env {
+		process.Env = append(process.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	// run in its own process group, so it can be stopped along with anything it spawns
+	process.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := process.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := process.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := process.Start(); err != nil {
+		return errors.New(fmt.Sprintf("Unable to launch plugin %s: %s", self.name, err.Error()))
+	}
+	log.Infof("Launched plugin %s[%d]", self.name, process.Process.Pid)
+
+	proc := &plugin_process{
+		cmd:      process,
+		stdin:    stdin,
+		requests: make(chan queued_request, PLUGIN_QUEUE),
+		pending:  map[int64]chan builtin_result{},
+		done:     make(chan bool),
+	}
+	self.process = proc
+
+	// requests are written from here, rather than the main loop, so that
+	// a plugin that stops reading its standard input can't block bmad
+	go func() {
+		for req := range proc.requests {
+			if _, err := stdin.Write(req.line); err != nil {
+				self.fail(proc, req.id, fmt.Sprintf("Unable to send request to plugin %s: %s", self.name, err.Error()))
+			}
+		}
+	}()
+
+	// both pipes must be drained before the plugin can be waited on
+	var reading sync.WaitGroup
+	reading.Add(2)
+	go func() {
+		defer reading.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Warnf("Plugin %s[%d]: %s", self.name, process.Process.Pid, scanner.Text())
+		}
+	}()
+	go func() {
+		defer reading.Done()
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) > 0 {
+				self.respond(proc, line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		reading.Wait()
+		err := process.Wait()
+		status := "exited"
+		if err != nil {
+			status = err.Error()
+		}
+		log.Warnf("Plugin %s[%d] has exited (%s)", self.name, process.Process.Pid, status)
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		proc.exited = true
+		close(proc.requests)
+		close(proc.done)
+		for id, results := range proc.pending {
+			results <- builtin_result{rc: UNKNOWN, err_msg: fmt.Sprintf("plugin %s exited (%s)", self.name, status)}
+			delete(proc.pending, id)
+		}
+		if self.process == proc {
+			self.process = nil
+		}
+	}()
+	return nil
+}
+
+// Passes a response from the plugin on to the Check waiting for it
+func (self *Plugin) respond(proc *plugin_process, line []byte) {
+	var resp plugin_response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		log.Warnf("Ignoring invalid response from plugin %s: %s", self.name, strings.TrimSpace(string(line)))
+		return
+	}
+
+	self.lock.Lock()
+	results, ok := proc.pending[resp.Id]
+	delete(proc.pending, resp.Id)
+	self.lock.Unlock()
+	if !ok {
+		log.Warnf("Ignoring response from plugin %s to unknown request %d", self.name, resp.Id)
+		return
+	}
+
+	switch {
+	case resp.Error != nil:
+		results <- builtin_result{rc: UNKNOWN, err_msg: resp.Error.Message}
+	case resp.Result != nil:
+		results <- builtin_result{rc: resp.Result.Rc, output: resp.Result.Output}
+	default:
+		results <- builtin_result{rc: UNKNOWN, err_msg: fmt.Sprintf("plugin %s sent a response with no result", self.name)}
+	}
+}
+
+// Fails a request the plugin has yet to answer, if the Check that sent it
+// is still waiting on it
+func (self *Plugin) fail(proc *plugin_process, id int64, msg string) {
+	self.lock.Lock()
+	results, ok := proc.pending[id]
+	delete(proc.pending, id)
+	self.lock.Unlock()
+	if ok {
+		results <- builtin_result{rc: UNKNOWN, err_msg: msg}
+	}
+}
+
+// Forgets the request whose results are sent to results, once the Check
+// that sent it has given up on it, so that unanswered requests don't pile up
+func (self *Plugin) abandon(results chan builtin_result) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.process == nil {
+		return
+	}
+	for id, pending := range self.process.pending {
+		if pending == results {
+			delete(self.process.pending, id)
+			return
+		}
+	}
+}
+
+// Asks the plugin to run a Check, launching the plugin if it isn't already
+// running. Returns a channel that the result of the run will be sent to.
+func (self *Plugin) run(check *Check) (chan builtin_result, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.process == nil {
+		if err := self.start(); err != nil {
+			return nil, err
+		}
+	}
+	proc := self.process
+	proc.next_id++
+	request, err := json.Marshal(plugin_request{
+		Jsonrpc: "2.0",
+		Id:      proc.next_id,
+		Method:  "run",
+		Params:  plugin_params{Check: check.Name, Params: check.Params, Timeout: check.Timeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// buffered, so that responses arriving after the check timed out don't block
+	results := make(chan builtin_result, 1)
+	proc.pending[proc.next_id] = results
+	select {
+	case proc.requests <- queued_request{id: proc.next_id, line: append(request, '\n')}:
+	default:
+		delete(proc.pending, proc.next_id)
+		return nil, errors.New(fmt.Sprintf("Unable to send request to plugin %s: too many requests waiting to be sent", self.name))
+	}
+	return results, nil
+}
+
+// Returns the time to wait between sending a stopping plugin SIGTERM, and SIGKILL
+func (self *Plugin) kill_after() int64 {
+	if self.Kill_after == nil {
+		return DEFAULT_KILL_AFTER
+	}
+	return *self.Kill_after
+}
+
+// Stops the plugin, if it's running, by closing its standard input, and
+// sending SIGTERM to its process group, followed by SIGKILL if the plugin
+// hasn't exited kill_after seconds later. Returns a channel that is closed
+// once the plugin has exited, or been sent SIGKILL.
+func (self *Plugin) Stop() chan bool {
+	stopped := make(chan bool)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.process == nil || self.process.exited {
+		close(stopped)
+		return stopped
+	}
+	proc := self.process
+	pid := proc.cmd.Process.Pid
+	log.Infof("Stopping plugin %s[%d]", self.name, pid)
+	proc.stdin.Close()
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		log.Errorf("Error sending SIGTERM to plugin %s[%d]: %s", self.name, pid, err.Error())
+	}
+	self.process = nil
+
+	go func(name string, grace time.Duration) {
+		defer close(stopped)
+		select {
+		case <-proc.done:
+		case <-time.After(grace):
+			log.Warnf("Plugin %s[%d] is still running %s after SIGTERM, sending SIGKILL", name, pid, grace)
+			if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+				log.Errorf("Error sending SIGKILL to plugin %s[%d]: %s", name, pid, err.Error())
+			}
+		}
+	}(self.name, time.Duration(self.kill_after())*time.Second)
+	return stopped
+}
+
+// Stops all running plugins, before bmad shuts down, waiting
+// for them to exit (or be killed)
+func StopPlugins() {
+	if cfg == nil {
+		return
+	}
+	var stopping []chan bool
+	for _, plugin := range cfg.Plugins {
+		stopping = append(stopping, plugin.Stop())
+	}
+	for _, stopped := range stopping {
+		<-stopped
+	}
+}
@@ -0,0 +1,274 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "os"
+import "regexp"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// Environment variable telling the test binary to act as a plugin
+const TEST_PLUGIN_ENV = "BMAD_TEST_PLUGIN"
+
+// Runs the test binary as a plugin, if it was launched as one by
+// the plugin tests, answering requests based on the check name
+func serve_test_plugin() {
+	if os.Getenv(TEST_PLUGIN_ENV) == "" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "test plugin starting up\n")
+
+	var lock sync.Mutex
+	reply := func (id int64, msg string) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Printf("{\"jsonrpc\":\"2.0\",\"id\":%d,%s}\n", id, msg)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req plugin_request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Printf("not json\n")
+			continue
+		}
+		go func (req plugin_request) {
+			switch req.Params.Check {
+			case "ok":
+				reply(req.Id, fmt.Sprintf("\"result\":{\"rc\":0,\"output\":\"pid %d\\n\"}", os.Getpid()))
+			case "warn":
+				reply(req.Id, "\"result\":{\"rc\":1,\"output\":\"not great\\n\"}")
+			case "params":
+				var params []string
+				for k, v := range req.Params.Params {
+					params = append(params, k+"="+v)
+				}
+				sort.Strings(params)
+				reply(req.Id, fmt.Sprintf("\"result\":{\"rc\":0,\"output\":\"%s timeout=%d\\n\"}",
+					strings.Join(params, " "), req.Params.Timeout))
+			case "fail":
+				reply(req.Id, "\"error\":{\"code\":-32000,\"message\":\"database unreachable\"}")
+			case "slow":
+				time.Sleep(2 * time.Second)
+				reply(req.Id, "\"result\":{\"rc\":0,\"output\":\"too late\\n\"}")
+			case "crash":
+				os.Exit(1)
+			}
+		}(req)
+	}
+	os.Exit(0)
+}
+
+func Test_initialize_plugin(t *testing.T) {
+	os.Setenv("BMAD_TEST_PLUGIN_TOKEN", "s3cr3t")
+	defer os.Unsetenv("BMAD_TEST_PLUGIN_TOKEN")
+	defaults := &Config{ Env: map[string]string{"PATH": "/bin", "LANG": "C"} }
+
+	plugin := Plugin{
+		Command: "/usr/lib/bolo/plugin --token ${BMAD_TEST_PLUGIN_TOKEN}",
+		Env:     map[string]string{"LANG": "en_US.UTF-8"},
+	}
+	err := initialize_plugin("python", &plugin, defaults)
+	assert.NoError(t, err, "No errors initializing plugins")
+	assert.Equal(t, "python", plugin.name, "plugins are named after their key")
+	assert.Equal(t, []string{"/usr/lib/bolo/plugin", "--token", "s3cr3t"}, plugin.cmd_args, "plugin commands are parsed and interpolated")
+	assert.Equal(t, map[string]string{"PATH": "/bin", "LANG": "en_US.UTF-8"}, plugin.Env, "plugins inherit the global env")
+
+	other := Plugin{ Command: "/usr/lib/bolo/plugin --token s3cr3t", Env: map[string]string{"LANG": "en_US.UTF-8"} }
+	initialize_plugin("python", &other, defaults)
+	assert.True(t, plugin.same(&other), "plugins with the same command and env are the same")
+	other.Env["LANG"] = "C"
+	assert.False(t, plugin.same(&other), "plugins with different env are not the same")
+
+	plugin = Plugin{}
+	err = initialize_plugin("python", &plugin, defaults)
+	assert.EqualError(t, err, "Unspecified command for plugin python", "plugins need a command")
+
+	kill_after := int64(-1)
+	plugin = Plugin{ Command: "plugin", Kill_after: &kill_after }
+	err = initialize_plugin("python", &plugin, defaults)
+	assert.EqualError(t, err, "Invalid kill_after -1 for plugin python, expected 0 or more seconds", "negative kill_after throws an error")
+
+	plugin = Plugin{ Command: "plugin --token ${BMAD_TEST_PLUGIN_UNSET}" }
+	err = initialize_plugin("python", &plugin, defaults)
+	assert.Error(t, err, "plugins referencing unset variables throw an error")
+}
+
+// Runs a plugin check, returning whether it finished within wait
+func (check *Check) test_plugin(t *testing.T, wait time.Duration) bool {
+	err := check.Spawn()
+	if !assert.NoError(t, err, "%s: no errors sending check to plugin", check.Name) {
+		return false
+	}
+	assert.True(t, check.running, "%s: check is running", check.Name)
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		if check.Reap() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_plugin_checks(t *testing.T) {
+	plugin := &Plugin{
+		Command: os.Args[0],
+		Env:     map[string]string{TEST_PLUGIN_ENV: "1"},
+	}
+	if err := initialize_plugin("test", plugin, &Config{}); err != nil {
+		t.Fatalf("Couldn't initialize test plugin: %s", err.Error())
+	}
+	cfg = &Config{
+		Host:    "test01.example.com",
+		Plugins: map[string]*Plugin{"test": plugin},
+	}
+	defer plugin.Stop()
+
+	check := Check{ Name: "ok", Plugin: "test", Every: 300, Timeout: 5 }
+	assert.True(t, check.test_plugin(t, 5 * time.Second), "plugin check finished")
+	assert.Equal(t, OK, check.rc, "plugin check rc is its result rc")
+	assert.Regexp(t, regexp.MustCompile("^pid \\d+\n$"), check.output, "plugin check output is its result output")
+	assert.False(t, check.running, "plugin check is no longer running")
+	assert.True(t, check.next_run.After(time.Now()), "plugin check is rescheduled")
+	first := check.output
+
+	assert.True(t, check.test_plugin(t, 5 * time.Second), "plugin check finished again")
+	assert.Equal(t, first, check.output, "plugins are only launched once")
+
+	output := check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("^pid \\d+\n\n\nSAMPLE \\d+ test01.example.com:bmad:ok:exec-time "), output,
+		"plugin check output and meta-stats are sent to bolo")
+
+	check = Check{ Name: "params", Plugin: "test", Every: 300, Timeout: 5, Params: map[string]string{"db": "main", "port": "5432"} }
+	check.test_plugin(t, 5 * time.Second)
+	assert.Equal(t, "db=main port=5432 timeout=5\n", check.output, "params and timeout are passed to the plugin")
+
+	check = Check{ Name: "warn", Plugin: "test", Every: 300, Timeout: 5, Exit_codes: map[string]string{"1": "CRITICAL"} }
+	check.test_plugin(t, 5 * time.Second)
+	assert.Equal(t, CRITICAL, check.rc, "plugin result rcs are mapped via exit_codes")
+	assert.Equal(t, 1, check.exit_code, "raw plugin result rc is kept")
+
+	check = Check{ Name: "fail", Plugin: "test", Every: 300, Timeout: 5, Bulk: TOGGLE_ON, Report: TOGGLE_ON }
+	check.test_plugin(t, 5 * time.Second)
+	assert.Equal(t, UNKNOWN, check.rc, "plugin errors are UNKNOWN")
+	assert.Equal(t, "", check.output, "plugin errors have no output")
+	output = check.test_submission(t, true, 0)
+	assert.Regexp(t, regexp.MustCompile("STATE \\d+ test01.example.com:bmad:fail 3 database unreachable\n"), output,
+		"plugin error messages are reported like stderr")
+
+	check = Check{ Name: "slow", Plugin: "test", Every: 300, Timeout: 1 }
+	assert.True(t, check.test_plugin(t, 3 * time.Second), "slow plugin check is abandoned")
+	assert.Equal(t, UNKNOWN, check.rc, "plugin checks that time out are UNKNOWN")
+	assert.True(t, check.timed_out(), "plugin checks that time out count as timeouts")
+	assert.Equal(t, "(timed out after 1s)", check.termination(), "plugin check timeouts are reported")
+	plugin.lock.Lock()
+	assert.Equal(t, 0, len(plugin.process.pending), "abandoned requests are no longer pending")
+	plugin.lock.Unlock()
+
+	check = Check{ Name: "crash", Plugin: "test", Every: 300, Timeout: 5 }
+	assert.True(t, check.test_plugin(t, 5 * time.Second), "plugin check finished when the plugin exited")
+	assert.Equal(t, UNKNOWN, check.rc, "plugin checks are UNKNOWN if the plugin exits")
+	assert.Equal(t, "plugin test exited (exit status 1)", check.err_msg, "plugin exits are reported")
+
+	check = Check{ Name: "ok", Plugin: "test", Every: 300, Timeout: 5 }
+	assert.True(t, check.test_plugin(t, 5 * time.Second), "plugin check finished after the plugin exited")
+	assert.Equal(t, OK, check.rc, "plugins are relaunched after exiting")
+	assert.NotEqual(t, first, check.output, "relaunched plugins are a new process")
+
+	plugin.Stop()
+	assert.Nil(t, plugin.process, "stopped plugins are no longer running")
+	assert.True(t, check.test_plugin(t, 5 * time.Second), "plugin check finished after the plugin was stopped")
+	assert.Equal(t, OK, check.rc, "plugins are relaunched after being stopped")
+
+	check = Check{ Name: "ok", Plugin: "missing", Every: 300, Timeout: 5 }
+	assert.EqualError(t, check.Spawn(), "Unknown plugin `missing`", "checks using plugins that no longer exist fail to spawn")
+}
+
+func Test_plugin_queue(t *testing.T) {
+	plugin := &Plugin{ Command: "sleep 10" }
+	if err := initialize_plugin("sleepy", plugin, &Config{}); err != nil {
+		t.Fatalf("Couldn't initialize test plugin: %s", err.Error())
+	}
+	defer plugin.Stop()
+
+	check := &Check{ Name: "ok", Plugin: "sleepy", Timeout: 5 }
+	var err error
+	done := make(chan bool)
+	go func () {
+		defer close(done)
+		for i := 0; i < 10 * PLUGIN_QUEUE && err == nil; i++ {
+			_, err = plugin.run(check)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sending requests to a plugin that isn't reading them blocked")
+	}
+	assert.EqualError(t, err, "Unable to send request to plugin sleepy: too many requests waiting to be sent",
+		"requests fail once too many are waiting to be sent to the plugin")
+}
+
+func Test_plugin_stop(t *testing.T) {
+	kill_after := int64(1)
+	plugin := &Plugin{ Command: "/bin/sh -c 'trap \"\" TERM; while true; do sleep 0.1; done'", Kill_after: &kill_after }
+	if err := initialize_plugin("stubborn", plugin, &Config{}); err != nil {
+		t.Fatalf("Couldn't initialize test plugin: %s", err.Error())
+	}
+	stop := func (message string) time.Duration {
+		plugin.lock.Lock()
+		err := plugin.start()
+		proc := plugin.process
+		plugin.lock.Unlock()
+		if err != nil {
+			t.Fatalf("Couldn't start test plugin: %s", err.Error())
+		}
+		time.Sleep(200 * time.Millisecond) // give the shell time to set its trap
+		started := time.Now()
+		select {
+		case <-plugin.Stop():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: plugin was never stopped", message)
+		}
+		stopped := time.Since(started)
+		select {
+		case <-proc.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: plugin never exited", message)
+		}
+		return stopped
+	}
+
+	assert.InDelta(t, 1, stop("ignoring SIGTERM").Seconds(), 0.5, "plugins that ignore SIGTERM are killed after kill_after")
+
+	kill_after = 0
+	assert.InDelta(t, 0, stop("no kill_after").Seconds(), 0.5, "plugins are killed right away with no kill_after")
+
+	kill_after = 10
+	plugin.Command = "sleep 10"
+	initialize_plugin("sleepy", plugin, &Config{})
+	assert.InDelta(t, 0, stop("exiting on SIGTERM").Seconds(), 0.5, "plugins that exit on SIGTERM aren't killed")
+
+	<-plugin.Stop() // stopping plugins that aren't running is a no-op
+}
+
+func Test_activate_config_plugins(t *testing.T) {
+	kept := &Plugin{ cmd_args: []string{"kept"}, process: &plugin_process{ exited: true } }
+	changed := &Plugin{ cmd_args: []string{"changed"} }
+	cfg = &Config{ Plugins: map[string]*Plugin{"kept": kept, "changed": changed, "removed": &Plugin{}} }
+
+	new_cfg := default_config()
+	new_cfg.Plugins = map[string]*Plugin{
+		"kept":    &Plugin{ cmd_args: []string{"kept"} },
+		"changed": &Plugin{ cmd_args: []string{"changed", "--verbose"} },
+	}
+	activate_config(new_cfg)
+	assert.Equal(t, kept, cfg.Plugins["kept"], "unchanged plugins are kept running across reloads")
+	assert.NotEqual(t, changed, cfg.Plugins["changed"], "changed plugins are replaced")
+	assert.Equal(t, 2, len(cfg.Plugins), "removed plugins are dropped")
+}
@@ -0,0 +1,275 @@
+package bma
+
+import "context"
+import "crypto/tls"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/url"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+// Maximum amount of an HTTP response body to read when matching it
+const MAX_PROBE_BODY int64 = 1024 * 1024
+
+// Time to leave between a probe giving up, and its check timing out, so
+// that the probe reports its own failure before reap_builtin abandons it
+const PROBE_MARGIN time.Duration = 1 * time.Second
+
+// DNS record types supported by the dns builtin
+var dns_types = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+
+// Function-variable for resolving name as a record of type qtype, via server
+// (or the system resolver, if unset), returning the answers found (used for
+// mocking during tests)
+var dns_lookup = func(server string, qtype string, name string, timeout time.Duration) ([]string, error) {
+	resolver := &net.Resolver{}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver.PreferGo = true
+		resolver.Dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		}
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var answers []string
+	switch qtype {
+	case "A", "AAAA":
+		network := "ip4"
+		if qtype == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			answers = append(answers, mx.Host)
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			answers = append(answers, ns.Host)
+		}
+	case "TXT":
+		return resolver.LookupTXT(ctx, name)
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported record type %s", qtype))
+	}
+	return answers, nil
+}
+
+// Validates the params of the tcp builtin
+func validate_tcp(params map[string]string) error {
+	if port, _ := number_param(params, "port", 0); port < 1 || port > 65535 || port != float64(int(port)) {
+		return errors.New(fmt.Sprintf("Invalid port `%s`, expected a number between 1 and 65535", params["port"]))
+	}
+	return nil
+}
+
+// Validates the params of the http builtin
+func validate_http(params map[string]string) error {
+	u, err := url.Parse(params["url"])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(fmt.Sprintf("Invalid url `%s`, expected an http:// or https:// URL", params["url"]))
+	}
+	if _, err := regexp.Compile(params["match"]); err != nil {
+		return errors.New(fmt.Sprintf("Invalid match `%s`: %s", params["match"], err.Error()))
+	}
+	if insecure_param(params) == toggle_invalid {
+		return errors.New("Invalid boolean value for insecure")
+	}
+	return nil
+}
+
+// Validates the params of the dns builtin
+func validate_dns(params map[string]string) error {
+	if qtype := params["type"]; qtype != "" && !contains(dns_types, strings.ToUpper(qtype)) {
+		return errors.New(fmt.Sprintf("Invalid type `%s`, expected one of: %s", qtype, strings.Join(dns_types, ", ")))
+	}
+	return nil
+}
+
+// Returns the insecure param of the http builtin, parsed like any other boolean directive
+func insecure_param(params map[string]string) Toggle {
+	var insecure Toggle
+	insecure.SetYAML("", params["insecure"])
+	return insecure
+}
+
+// Returns the seconds elapsed since start, rounded to 4 decimal places
+func elapsed(start time.Time) float64 {
+	s, _ := strconv.ParseFloat(strconv.FormatFloat(time.Since(start).Seconds(), 'f', 4, 64), 64)
+	return s
+}
+
+// Returns how long a probe should wait before giving up, given the timeout
+// of its check: PROBE_MARGIN short of the timeout, or half the timeout, if
+// it's too short to leave that much margin (0 still means no deadline)
+func probe_deadline(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return timeout
+	}
+	if timeout <= 2*PROBE_MARGIN {
+		return timeout / 2
+	}
+	return timeout - PROBE_MARGIN
+}
+
+// Reports how long it takes to connect to a TCP port. Ports
+// that can't be connected to are CRITICAL.
+func builtin_tcp(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	addr := net.JoinHostPort(params["host"], params["port"])
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, probe_deadline(timeout))
+	if err != nil {
+		return CRITICAL, fmt.Sprintf("Unable to connect to %s: %s", addr, err.Error()), nil, nil
+	}
+	latency := elapsed(start)
+	conn.Close()
+
+	rc := threshold(params, latency, "warn", "crit", 0, 0)
+	return rc, fmt.Sprintf("connected to %s in %0.3fs", addr, latency), []sample{{"latency", latency}}, nil
+}
+
+// Reports how long it takes to fetch a URL, checking its status code
+// (against the status param, or for any error if unset), its body
+// (against the match regex), and for HTTPS, how many days remain until
+// its certificate expires (cert_warn and cert_crit, 30 and 7 by default).
+func builtin_http(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	client := &http.Client{
+		Timeout: probe_deadline(timeout),
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure_param(params).On()},
+			DisableKeepAlives: true,
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Get(params["url"])
+	if err != nil {
+		return CRITICAL, fmt.Sprintf("Unable to fetch %s: %s", params["url"], err.Error()), nil, nil
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_PROBE_BODY))
+	latency := elapsed(start)
+	if err != nil {
+		return CRITICAL, fmt.Sprintf("Unable to read response from %s: %s", params["url"], err.Error()), nil, nil
+	}
+
+	rc := threshold(params, latency, "warn", "crit", 0, 0)
+	var problems []string
+	samples := []sample{{"latency", latency}, {"status", float64(resp.StatusCode)}}
+	if status, _ := number_param(params, "status", 0); status > 0 && float64(resp.StatusCode) != status {
+		rc = CRITICAL
+		problems = append(problems, fmt.Sprintf("expected status %g", status))
+	} else if status == 0 && resp.StatusCode >= 400 {
+		rc = CRITICAL
+	}
+	if match := params["match"]; match != "" && !regexp.MustCompile(match).Match(body) {
+		rc = CRITICAL
+		problems = append(problems, fmt.Sprintf("body does not match `%s`", match))
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		days := time.Until(resp.TLS.PeerCertificates[0].NotAfter).Hours() / 24
+		samples = append(samples, sample{"cert-expiry-days", round(days)})
+		cert_warn, _ := number_param(params, "cert_warn", 30)
+		cert_crit, _ := number_param(params, "cert_crit", 7)
+		if days < cert_crit {
+			rc = CRITICAL
+			problems = append(problems, fmt.Sprintf("certificate expires in %d days", int64(days)))
+		} else if days < cert_warn {
+			rc = worst(rc, WARNING)
+			problems = append(problems, fmt.Sprintf("certificate expires in %d days", int64(days)))
+		}
+	}
+
+	msg := fmt.Sprintf("%s returned %s in %0.3fs", params["url"], resp.Status, latency)
+	if len(problems) > 0 {
+		msg = fmt.Sprintf("%s (%s)", msg, strings.Join(problems, ", "))
+	}
+	return rc, msg, samples, nil
+}
+
+// Reports how long it takes to resolve a DNS record (of type A, by default),
+// checking that each of the answers listed in the expect param (comma-separated)
+// was returned. Records that can't be resolved are CRITICAL.
+func builtin_dns(params map[string]string, timeout time.Duration) (int, string, []sample, error) {
+	qtype := strings.ToUpper(params["type"])
+	if qtype == "" {
+		qtype = "A"
+	}
+	start := time.Now()
+	answers, err := dns_lookup(params["server"], qtype, params["name"], probe_deadline(timeout))
+	latency := elapsed(start)
+	if err != nil {
+		return CRITICAL, fmt.Sprintf("Unable to resolve %s %s: %s", qtype, params["name"], err.Error()), nil, nil
+	}
+	if len(answers) == 0 {
+		return CRITICAL, fmt.Sprintf("No %s records found for %s", qtype, params["name"]), nil, nil
+	}
+
+	// names are case-insensitive, and may or may not be fully-qualified
+	normalize := func(answer string) string {
+		if qtype == "TXT" {
+			return answer
+		}
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(answer)), ".")
+	}
+	rc := threshold(params, latency, "warn", "crit", 0, 0)
+	var missing []string
+	for _, expect := range strings.Split(params["expect"], ",") {
+		if strings.TrimSpace(expect) == "" {
+			continue
+		}
+		found := false
+		for _, answer := range answers {
+			if normalize(answer) == normalize(expect) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, strings.TrimSpace(expect))
+		}
+	}
+
+	msg := fmt.Sprintf("%s %s resolved to %s in %0.3fs", qtype, params["name"], strings.Join(answers, ", "), latency)
+	if len(missing) > 0 {
+		rc = CRITICAL
+		msg = fmt.Sprintf("%s (expected %s)", msg, strings.Join(missing, ", "))
+	}
+	return rc, msg, []sample{{"latency", latency}, {"answers", float64(len(answers))}}, nil
+}
@@ -0,0 +1,197 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "regexp"
+import "strings"
+import "time"
+
+func Test_validate_probes(t *testing.T) {
+	assert.NoError(t, validate_builtin("tcp", map[string]string{"host": "localhost", "port": "22"}), "valid tcp params are accepted")
+	assert.EqualError(t, validate_builtin("tcp", map[string]string{"host": "localhost"}),
+		"Builtin tcp requires the port param", "tcp probes need a port")
+	assert.EqualError(t, validate_builtin("tcp", map[string]string{"host": "localhost", "port": "70000"}),
+		"Invalid port `70000`, expected a number between 1 and 65535", "ports out of range are rejected")
+
+	assert.NoError(t, validate_builtin("http", map[string]string{"url": "https://example.com/health", "match": "^ok", "insecure": "yes"}),
+		"valid http params are accepted")
+	assert.EqualError(t, validate_builtin("http", map[string]string{"url": "example.com"}),
+		"Invalid url `example.com`, expected an http:// or https:// URL", "urls without a scheme are rejected")
+	assert.EqualError(t, validate_builtin("http", map[string]string{"url": "ftp://example.com"}),
+		"Invalid url `ftp://example.com`, expected an http:// or https:// URL", "non-http urls are rejected")
+	assert.EqualError(t, validate_builtin("http", map[string]string{"url": "http://example.com", "match": "(ok"}),
+		"Invalid match `(ok`: error parsing regexp: missing closing ): `(ok`", "bad regexes are rejected")
+	assert.EqualError(t, validate_builtin("http", map[string]string{"url": "http://example.com", "insecure": "maybe"}),
+		"Invalid boolean value for insecure", "bad booleans are rejected")
+
+	assert.NoError(t, validate_builtin("dns", map[string]string{"name": "example.com", "type": "mx"}), "valid dns params are accepted")
+	assert.EqualError(t, validate_builtin("dns", map[string]string{"name": "example.com", "type": "SRV"}),
+		"Invalid type `SRV`, expected one of: A, AAAA, CNAME, MX, NS, TXT", "unsupported record types are rejected")
+}
+
+func Test_probe_deadline(t *testing.T) {
+	assert.Equal(t, 9 * time.Second, probe_deadline(10 * time.Second), "probes give up a second before their check times out")
+	assert.Equal(t, 1 * time.Second, probe_deadline(2 * time.Second), "probes with short timeouts give up halfway through")
+	assert.Equal(t, 500 * time.Millisecond, probe_deadline(1 * time.Second), "probes with short timeouts give up halfway through")
+	assert.Equal(t, time.Duration(0), probe_deadline(0), "probes without a timeout have no deadline")
+}
+
+func Test_builtin_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen on a local port: %s", err.Error())
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	rc, msg, samples, err := builtin_tcp(map[string]string{"host": host, "port": port}, time.Second)
+	assert.NoError(t, err, "No errors probing tcp ports")
+	assert.Equal(t, OK, rc, "listening ports are OK")
+	assert.Regexp(t, regexp.MustCompile("^connected to 127.0.0.1:"+port+" in \\d+\\.\\d{3}s$"), msg, "connection latency is reported")
+	assert.Equal(t, "latency", samples[0].name, "connection latency is sampled")
+
+	l.Close()
+	rc, msg, samples, err = builtin_tcp(map[string]string{"host": host, "port": port}, time.Second)
+	assert.NoError(t, err, "No errors probing closed tcp ports")
+	assert.Equal(t, CRITICAL, rc, "closed ports are CRITICAL")
+	assert.Regexp(t, regexp.MustCompile("^Unable to connect to 127.0.0.1:"+port+": .*connection refused"), msg,
+		"connection failures are reported")
+	assert.Nil(t, samples, "no latency is sampled for failed connections")
+}
+
+func Test_builtin_http(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprintf(w, "status: ok\n")
+		case "/moved":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	rc, msg, samples, err := builtin_http(map[string]string{"url": server.URL + "/health", "match": "status: ok"}, time.Second)
+	assert.NoError(t, err, "No errors probing http servers")
+	assert.Equal(t, OK, rc, "healthy urls are OK")
+	assert.Regexp(t, regexp.MustCompile("^"+server.URL+"/health returned 200 OK in \\d+\\.\\d{3}s$"), msg, "status is reported")
+	assert.Equal(t, 2, len(samples), "latency and status are sampled")
+	assert.Equal(t, sample{ "status", 200 }, samples[1], "status code is sampled")
+
+	rc, _, _, _ = builtin_http(map[string]string{"url": server.URL + "/moved"}, time.Second)
+	assert.Equal(t, OK, rc, "redirects are followed")
+
+	rc, msg, _, _ = builtin_http(map[string]string{"url": server.URL + "/missing"}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "error statuses are CRITICAL")
+	assert.Contains(t, msg, "returned 404 Not Found", "error statuses are reported")
+
+	rc, msg, _, _ = builtin_http(map[string]string{"url": server.URL + "/missing", "status": "404"}, time.Second)
+	assert.Equal(t, OK, rc, "expected statuses are OK")
+	rc, msg, _, _ = builtin_http(map[string]string{"url": server.URL + "/health", "status": "204"}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "unexpected statuses are CRITICAL")
+	assert.Contains(t, msg, "(expected status 204)", "unexpected statuses are reported")
+
+	rc, msg, _, _ = builtin_http(map[string]string{"url": server.URL + "/health", "match": "^status: (up|green)"}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "bodies that don't match are CRITICAL")
+	assert.Contains(t, msg, "(body does not match `^status: (up|green)`)", "body mismatches are reported")
+
+	url := server.URL
+	server.Close()
+	rc, msg, samples, err = builtin_http(map[string]string{"url": url}, time.Second)
+	assert.NoError(t, err, "No errors probing unreachable http servers")
+	assert.Equal(t, CRITICAL, rc, "unreachable urls are CRITICAL")
+	assert.True(t, strings.HasPrefix(msg, "Unable to fetch "+url+": "), "fetch failures are reported")
+	assert.Nil(t, samples, "nothing is sampled for failed requests")
+}
+
+func Test_builtin_https(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok\n")
+	}))
+	defer server.Close()
+
+	rc, msg, _, _ := builtin_http(map[string]string{"url": server.URL}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "untrusted certificates are CRITICAL")
+	assert.Contains(t, msg, "certificate", "certificate errors are reported")
+
+	rc, msg, samples, err := builtin_http(map[string]string{"url": server.URL, "insecure": "true"}, time.Second)
+	assert.NoError(t, err, "No errors probing https servers")
+	assert.Equal(t, OK, rc, "certificates far from expiry are OK")
+	assert.Equal(t, "cert-expiry-days", samples[2].name, "days until certificate expiry are sampled")
+	days := samples[2].value
+
+	rc, msg, _, _ = builtin_http(map[string]string{"url": server.URL, "insecure": "true",
+		"cert_warn": fmt.Sprintf("%d", int64(days) + 10)}, time.Second)
+	assert.Equal(t, WARNING, rc, "certificates expiring within cert_warn days are WARNING")
+	assert.Contains(t, msg, fmt.Sprintf("(certificate expires in %d days)", int64(days)), "certificate expiry is reported")
+
+	rc, _, _, _ = builtin_http(map[string]string{"url": server.URL, "insecure": "true",
+		"cert_crit": fmt.Sprintf("%d", int64(days) + 10)}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "certificates expiring within cert_crit days are CRITICAL")
+}
+
+func Test_builtin_dns(t *testing.T) {
+	orig_dns_lookup := dns_lookup
+	defer func () { dns_lookup = orig_dns_lookup }()
+
+	var queried []string
+	dns_lookup = func (server string, qtype string, name string, timeout time.Duration) ([]string, error) {
+		queried = []string{server, qtype, name}
+		switch qtype + " " + name {
+		case "A www.example.com":
+			return []string{"192.0.2.10", "192.0.2.11"}, nil
+		case "CNAME web.example.com":
+			return []string{"www.example.com."}, nil
+		case "TXT example.com":
+			return []string{}, nil
+		case "TXT multiline.example.com":
+			return []string{"v=spf1 -all\nSTATE 1234567890 evil.example.com:check 0 injected"}, nil
+		case "TXT broken.example.com":
+			return nil, errors.New("server misbehaving\r\nSTATE 1234567890 evil.example.com:check 0 injected")
+		}
+		return nil, errors.New("no such host")
+	}
+
+	rc, msg, samples, err := builtin_dns(map[string]string{"name": "www.example.com", "expect": "192.0.2.11"}, time.Second)
+	assert.NoError(t, err, "No errors probing dns records")
+	assert.Equal(t, []string{"", "A", "www.example.com"}, queried, "A records are looked up by default, via the system resolver")
+	assert.Equal(t, OK, rc, "expected answers are OK")
+	assert.Regexp(t, regexp.MustCompile("^A www.example.com resolved to 192.0.2.10, 192.0.2.11 in \\d+\\.\\d{3}s$"), msg,
+		"answers are reported")
+	assert.Equal(t, "latency", samples[0].name, "lookup latency is sampled")
+	assert.Equal(t, sample{ "answers", 2 }, samples[1], "number of answers is sampled")
+
+	rc, msg, _, _ = builtin_dns(map[string]string{"name": "www.example.com", "expect": "192.0.2.10, 192.0.2.99"}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "missing answers are CRITICAL")
+	assert.Contains(t, msg, "(expected 192.0.2.99)", "missing answers are reported")
+
+	rc, _, _, _ = builtin_dns(map[string]string{"name": "web.example.com", "type": "cname", "server": "192.0.2.53",
+		"expect": "WWW.example.com"}, time.Second)
+	assert.Equal(t, []string{"192.0.2.53", "CNAME", "web.example.com"}, queried, "records are looked up via the given server")
+	assert.Equal(t, OK, rc, "names are compared case-insensitively, with or without the trailing dot")
+
+	rc, msg, _, _ = builtin_dns(map[string]string{"name": "example.com", "type": "TXT"}, time.Second)
+	assert.Equal(t, CRITICAL, rc, "records with no answers are CRITICAL")
+	assert.Equal(t, "No TXT records found for example.com", msg, "empty answers are reported")
+
+	rc, msg, samples, err = builtin_dns(map[string]string{"name": "nxdomain.example.com"}, time.Second)
+	assert.NoError(t, err, "No errors probing missing dns records")
+	assert.Equal(t, CRITICAL, rc, "records that can't be resolved are CRITICAL")
+	assert.Equal(t, "Unable to resolve A nxdomain.example.com: no such host", msg, "resolution failures are reported")
+	assert.Nil(t, samples, "nothing is sampled for failed lookups")
+
+	cfg = &Config{ Host: "test01.example.com" }
+	for _, name := range []string{"multiline.example.com", "broken.example.com"} {
+		check := Check{ Name: "dns_txt", Builtin: "dns", Timeout: 1,
+			Params: map[string]string{"name": name, "type": "TXT", "expect": "v=spf1"} }
+		result := check.run_builtin("test01.example.com")
+		assert.Regexp(t, regexp.MustCompile("^STATE \\d+ test01.example.com:dns_txt \\d [^\r\n]*injected[^\r\n]*\n"), result.output,
+			"newlines in %s answers and errors are kept out of the STATE message", name)
+		assert.NotContains(t, result.output, "\nSTATE 1234567890 evil.example.com", "%s can't inject messages for bolo", name)
+	}
+}
@@ -0,0 +1,96 @@
+package bma
+
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+// Location of the proc filesystem (overridden during tests)
+var proc_root = "/proc"
+
+// Processes, as seen in /proc/<pid>/stat
+type proc_stat struct {
+	pid   int
+	comm  string
+	state string
+	ppid  int
+	pgrp  int
+}
+
+// Parses /proc/<pid>/stat for a process
+func read_proc_stat(pid int) (proc_stat, error) {
+	source, err := ioutil.ReadFile(filepath.Join(proc_root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return proc_stat{}, err
+	}
+	return parse_proc_stat(string(source))
+}
+
+// Parses the contents of a /proc/<pid>/stat file. The command name
+// is wrapped in parens, and may contain spaces and parens itself,
+// so everything else is found relative to the last paren.
+func parse_proc_stat(stat string) (proc_stat, error) {
+	open := strings.Index(stat, "(")
+	end := strings.LastIndex(stat, ")")
+	if open < 0 || end < open {
+		return proc_stat{}, errors.New(fmt.Sprintf("Unable to parse process stat `%s`", strings.TrimSpace(stat)))
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 3 {
+		return proc_stat{}, errors.New(fmt.Sprintf("Unable to parse process stat `%s`", strings.TrimSpace(stat)))
+	}
+
+	var p proc_stat
+	var err error
+	if p.pid, err = strconv.Atoi(strings.TrimSpace(stat[:open])); err != nil {
+		return proc_stat{}, err
+	}
+	p.comm = stat[open+1 : end]
+	p.state = fields[0]
+	if p.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return proc_stat{}, err
+	}
+	if p.pgrp, err = strconv.Atoi(fields[2]); err != nil {
+		return proc_stat{}, err
+	}
+	return p, nil
+}
+
+// Returns all running (non-zombie) processes
+func list_processes() ([]proc_stat, error) {
+	entries, err := ioutil.ReadDir(proc_root)
+	if err != nil {
+		return nil, err
+	}
+	var procs []proc_stat
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// processes may exit while we're looking
+		p, err := read_proc_stat(pid)
+		if err != nil || p.state == "Z" {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// Returns the pids of any running processes in the process group pgid
+func process_group(pgid int) ([]int, error) {
+	procs, err := list_processes()
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, p := range procs {
+		if p.pgrp == pgid {
+			pids = append(pids, p.pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,32 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+
+func Test_parse_proc_stat(t *testing.T) {
+	p, err := parse_proc_stat("4242 (my (weird) cmd) S 1 4240 4240 0 -1 4194560 100 0 0 0\n")
+	assert.NoError(t, err, "No errors parsing process stats")
+	assert.Equal(t, proc_stat{pid: 4242, comm: "my (weird) cmd", state: "S", ppid: 1, pgrp: 4240}, p,
+		"process stats are parsed, despite parens in the command name")
+
+	_, err = parse_proc_stat("4242 garbage\n")
+	assert.EqualError(t, err, "Unable to parse process stat `4242 garbage`", "bad process stats return an error")
+}
+
+func Test_process_group(t *testing.T) {
+	orig_proc_root := proc_root
+	proc_root = "t/data/proc"
+	defer func () { proc_root = orig_proc_root }()
+
+	pids, err := process_group(100)
+	assert.NoError(t, err, "No errors finding process group members")
+	assert.Equal(t, []int{100, 101}, pids, "running members of the process group are found")
+
+	pids, err = process_group(300)
+	assert.NoError(t, err, "No errors finding empty process groups")
+	assert.Nil(t, pids, "empty process groups have no members")
+
+	proc_root = "t/data/nonexistent"
+	_, err = process_group(100)
+	assert.Error(t, err, "missing /proc returns an error")
+}
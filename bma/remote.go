@@ -0,0 +1,277 @@
+package bma
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "github.com/starkandwayne/goutils/log"
+import "io/ioutil"
+import "mime"
+import "net/http"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "time"
+
+// Remotes describe an HTTP(S) endpoint serving an auxillary config
+// (a YAML, JSON, or TOML document of checks), which is merged in with
+// the checks from the local config files.
+type Remote struct {
+	Url     string // URL of the document to fetch checks from
+	Every   int64  // Interval to poll the URL for changes (in seconds)
+	Timeout int64  // Maximum time to wait for a response from the URL (in seconds)
+	Cache   string // File to cache the last good copy of the document in ("" to disable)
+}
+
+// Metadata about the cached copy of a remote config, used
+// to make conditional requests for the document
+type remote_meta struct {
+	Url           string `json:"url"`
+	Etag          string `json:"etag"`
+	Last_modified string `json:"last_modified"`
+	Content_type  string `json:"content_type"`
+}
+
+// A copy of a Remote's config document, along with its metadata
+type remote_document struct {
+	body []byte
+	meta *remote_meta
+}
+
+// The latest copy of the remote config document fetched by a Poller,
+// which reloads use rather than fetching the document again themselves
+var remote_latest struct {
+	sync.Mutex
+	doc *remote_document
+}
+
+// Pollers periodically check a Remote for changes, notifying
+// bmad when a config reload is needed.
+type Poller struct {
+	stop chan bool
+	last *remote_document // latest copy of the document seen, starting with the one the config was loaded from
+}
+
+// Loads the checks and templates defined by the Remote's config document,
+// returning them along with the copy of the document they came from. If bmad
+// already has a copy of the document in memory (the latest copy fetched by a
+// Poller, or failing that, the applied copy the current config was loaded
+// from), it's used as is, so that reloads don't wait on the endpoint.
+// Otherwise, the document is fetched, conditional on the ETag and
+// Last-Modified headers of the cached copy on disk, if any. If the endpoint
+// can't be reached, or the document can't be parsed, the last good copy
+// (the applied copy, or the cached copy) is used instead, and returned
+// along with the error. Successfully parsed documents are cached on disk
+// for next time.
+func load_remote(r Remote, latest *remote_document, applied *remote_document) (map[string]*Check, map[string]*Check, *remote_document, error) {
+	cached := read_remote_cache(r)
+	last_good := applied
+	if last_good == nil {
+		last_good = cached
+	}
+
+	doc := latest
+	if doc == nil {
+		doc = applied
+	}
+	var err error
+	if doc == nil {
+		doc, err = fetch_remote(r, cached)
+		if err == nil && doc == nil {
+			log.Debugf("%s has not changed, using cached copy from %s", r.Url, r.Cache)
+			doc = cached
+		}
+	}
+	if err == nil {
+		checks, templates, parse_err := doc.parse(r.Url)
+		if parse_err == nil {
+			if cached == nil || !bytes.Equal(doc.body, cached.body) {
+				write_remote_cache(r, doc)
+			}
+			return checks, templates, doc, nil
+		}
+		err = errors.New(fmt.Sprintf("Could not parse config: %s", parse_err.Error()))
+	}
+
+	if last_good == nil || last_good == doc {
+		return nil, nil, nil, err
+	}
+	checks, templates, parse_err := last_good.parse(r.Url)
+	if parse_err != nil {
+		return nil, nil, nil, err
+	}
+	return checks, templates, last_good, err
+}
+
+// Parses the checks and templates out of a copy of the config document from remote_url
+func (self *remote_document) parse(remote_url string) (map[string]*Check, map[string]*Check, error) {
+	return parse_include(remote_format(remote_url, self.meta.Content_type), self.body)
+}
+
+// Makes a request for the Remote's config document, conditional on the
+// ETag and Last-Modified headers of the given copy, if any. Returns the
+// document, if it was served. If the given copy is still current, the
+// returned document is nil.
+func fetch_remote(r Remote, current *remote_document) (*remote_document, error) {
+	req, err := http.NewRequest("GET", r.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		if current.meta.Etag != "" {
+			req.Header.Set("If-None-Match", current.meta.Etag)
+		}
+		if current.meta.Last_modified != "" {
+			req.Header.Set("If-Modified-Since", current.meta.Last_modified)
+		}
+	}
+
+	client := &http.Client{Timeout: time.Duration(r.Timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && current != nil {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Unexpected response: %s", resp.Status))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &remote_document{body: body, meta: &remote_meta{
+		Url:           r.Url,
+		Etag:          resp.Header.Get("ETag"),
+		Last_modified: resp.Header.Get("Last-Modified"),
+		Content_type:  resp.Header.Get("Content-Type"),
+	}}, nil
+}
+
+// Returns a file name for the Remote's config document, whose extension
+// tells unmarshal_config what format to parse it as. The Content-Type
+// takes precedence, falling back to the extension in the URL path.
+func remote_format(remote_url string, content_type string) string {
+	media_type, _, _ := mime.ParseMediaType(content_type)
+	switch {
+	case strings.Contains(media_type, "json"):
+		return "remote.json"
+	case strings.Contains(media_type, "toml"):
+		return "remote.toml"
+	case strings.Contains(media_type, "yaml"):
+		return "remote.yml"
+	}
+	if u, err := url.Parse(remote_url); err == nil {
+		return u.Path
+	}
+	return remote_url
+}
+
+// Returns the cached copy of the Remote's config document, or nil
+// if there is no cached copy (or it was cached from a different URL)
+func read_remote_cache(r Remote) *remote_document {
+	if r.Cache == "" {
+		return nil
+	}
+	var meta remote_meta
+	source, err := ioutil.ReadFile(r.Cache + ".meta")
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(source, &meta); err != nil || meta.Url != r.Url {
+		return nil
+	}
+	cached, err := ioutil.ReadFile(r.Cache)
+	if err != nil {
+		return nil
+	}
+	return &remote_document{body: cached, meta: &meta}
+}
+
+// Caches the Remote's config document (and its metadata) on disk
+func write_remote_cache(r Remote, doc *remote_document) {
+	if r.Cache == "" {
+		return
+	}
+	source, err := json.Marshal(doc.meta)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.Cache), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(r.Cache, doc.body, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(r.Cache+".meta", source, 0644)
+	}
+	if err != nil {
+		log.Warnf("Couldn't cache config from %s in %s: %s", r.Url, r.Cache, err.Error())
+	}
+}
+
+// Returns the latest copy of the config document at remote_url fetched by a Poller, if any
+func latest_remote(remote_url string) *remote_document {
+	remote_latest.Lock()
+	defer remote_latest.Unlock()
+	if remote_latest.doc == nil || remote_latest.doc.meta.Url != remote_url {
+		return nil
+	}
+	return remote_latest.doc
+}
+
+// Fetches the Remote's config document, conditional on the latest copy
+// seen, returning true if a different document is being served. The new
+// document is kept in memory, for the resulting reload to use. Documents
+// are compared against the latest copy seen (rather than the cached copy
+// on disk), so that a document that fails to load only triggers one reload.
+func (p *Poller) poll(r Remote) (bool, error) {
+	doc, err := fetch_remote(r, p.last)
+	if err != nil || doc == nil {
+		return false, err
+	}
+	changed := p.last == nil || !bytes.Equal(doc.body, p.last.body)
+	p.last = doc
+	if changed {
+		remote_latest.Lock()
+		remote_latest.doc = doc
+		remote_latest.Unlock()
+	}
+	return changed, nil
+}
+
+// Starts polling the Remote of c for changes every Remote.Every seconds,
+// calling notify whenever the Remote serves a new config document.
+// Returns nil if no Remote is configured.
+func PollRemote(c *Config, notify func()) *Poller {
+	if c.Remote.Url == "" {
+		return nil
+	}
+	p := &Poller{stop: make(chan bool), last: c.remote}
+	go func(r Remote) {
+		ticker := time.NewTicker(time.Duration(r.Every) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				changed, err := p.poll(r)
+				if err != nil {
+					log.Warnf("Couldn't poll %s for changes: %s", r.Url, err.Error())
+				} else if changed {
+					notify()
+				}
+			}
+		}
+	}(c.Remote)
+	return p
+}
+
+// Stops polling for changes
+func (p *Poller) Close() {
+	close(p.stop)
+}
@@ -0,0 +1,257 @@
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "sort"
+import "time"
+
+// Serves a config document, keeping track of the conditional
+// request headers sent by bmad
+type remote_server struct {
+	body         string
+	content_type string
+	etag         string
+	status       int
+	if_none      string
+}
+
+func (self *remote_server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.if_none = r.Header.Get("If-None-Match")
+	if self.status != 0 {
+		w.WriteHeader(self.status)
+		return
+	}
+	if self.etag != "" && self.if_none == self.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", self.etag)
+	w.Header().Set("Content-Type", self.content_type)
+	fmt.Fprint(w, self.body)
+}
+
+func check_names(checks map[string]*Check) []string {
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Test_load_remote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmad-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &remote_server{
+		body:         "remote_check:\n  command: echo \"remote\"\n",
+		content_type: "application/x-yaml",
+		etag:         `"v1"`,
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r := Remote{Url: ts.URL + "/checks", Timeout: 5, Cache: dir + "/cache/remote"}
+
+	checks, _, doc, err := load_remote(r, nil, nil)
+	assert.Nil(t, err, "load_remote() doesn't return an error for a valid document")
+	assert.Equal(t, []string{"remote_check"}, check_names(checks), "load_remote() returns the served checks")
+	assert.Equal(t, server.body, string(doc.body), "load_remote() returns the document the checks came from")
+	assert.Equal(t, "", server.if_none, "first request is unconditional")
+	cached, _ := ioutil.ReadFile(r.Cache)
+	assert.Equal(t, server.body, string(cached), "served document is cached")
+
+	checks, _, _, err = load_remote(r, nil, nil)
+	assert.Nil(t, err, "load_remote() doesn't return an error for an unmodified document")
+	assert.Equal(t, `"v1"`, server.if_none, "subsequent requests are conditional on the ETag")
+	assert.Equal(t, []string{"remote_check"}, check_names(checks), "load_remote() uses the cache for unmodified documents")
+
+	server.body = `{ "json_check": { "command": "echo json" }, "defaults": { "every": 60 } }`
+	server.content_type = "application/json; charset=utf-8"
+	server.etag = `"v2"`
+	checks, _, _, err = load_remote(r, nil, nil)
+	assert.Nil(t, err, "load_remote() doesn't return an error for a valid json document")
+	assert.Equal(t, []string{"json_check"}, check_names(checks), "load_remote() parses documents according to their Content-Type")
+	assert.Equal(t, int64(60), checks["json_check"].file_defaults.Every, "remote documents can provide defaults")
+
+	server.body = `{ "broken": `
+	server.etag = `"v3"`
+	checks, _, doc, err = load_remote(r, nil, nil)
+	assert.Error(t, err, "load_remote() returns an error for unparseable documents")
+	assert.Equal(t, []string{"json_check"}, check_names(checks), "load_remote() falls back to the cache for unparseable documents")
+	assert.Equal(t, `"v2"`, doc.meta.Etag, "unparseable documents aren't cached")
+
+	server.status = http.StatusInternalServerError
+	checks, _, _, err = load_remote(r, nil, nil)
+	assert.EqualError(t, err, "Unexpected response: 500 Internal Server Error", "load_remote() returns an error when the endpoint fails")
+	assert.Equal(t, []string{"json_check"}, check_names(checks), "load_remote() falls back to the cache when the endpoint fails")
+
+	_, _, doc, err = load_remote(Remote{Url: ts.URL + "/checks", Timeout: 5, Cache: dir + "/other"}, nil, nil)
+	assert.EqualError(t, err, "Unexpected response: 500 Internal Server Error",
+		"load_remote() returns an error if the endpoint fails, and nothing is cached")
+	assert.Nil(t, doc, "load_remote() returns no document if the endpoint fails, and nothing is cached")
+
+	_, _, _, err = load_remote(Remote{Url: ts.URL + "/other", Timeout: 5, Cache: r.Cache}, nil, nil)
+	assert.EqualError(t, err, "Unexpected response: 500 Internal Server Error",
+		"load_remote() ignores cached documents from other URLs")
+
+	// copies of the document already in memory are used without fetching it
+	r = Remote{Url: ts.URL + "/checks", Timeout: 5}
+	applied := &remote_document{body: []byte("applied: { command: echo }\n"), meta: &remote_meta{Url: r.Url}}
+	latest := &remote_document{body: []byte("latest: { command: echo }\n"), meta: &remote_meta{Url: r.Url}}
+	checks, _, doc, err = load_remote(r, nil, applied)
+	assert.Nil(t, err, "load_remote() doesn't return an error for the applied document")
+	assert.Equal(t, []string{"applied"}, check_names(checks), "load_remote() reuses the applied document")
+	assert.True(t, applied == doc, "load_remote() returns the applied document")
+
+	checks, _, doc, err = load_remote(r, latest, applied)
+	assert.Nil(t, err, "load_remote() doesn't return an error for the latest document")
+	assert.Equal(t, []string{"latest"}, check_names(checks), "load_remote() prefers the latest document fetched by a poller")
+
+	latest.body = []byte("broken: [")
+	checks, _, doc, err = load_remote(r, latest, applied)
+	assert.Error(t, err, "load_remote() returns an error if the latest document can't be parsed")
+	assert.Equal(t, []string{"applied"}, check_names(checks), "load_remote() falls back to the applied document")
+	assert.True(t, applied == doc, "load_remote() returns the applied document it fell back to")
+}
+
+func Test_remote_format(t *testing.T) {
+	assert.Equal(t, "remote.json", remote_format("http://example.com/checks", "application/json"), "json content types are json")
+	assert.Equal(t, "remote.toml", remote_format("http://example.com/checks", "application/toml"), "toml content types are toml")
+	assert.Equal(t, "remote.yml", remote_format("http://example.com/checks.json", "text/yaml; charset=utf-8"),
+		"content type takes precedence over url")
+	assert.Equal(t, "/checks.json", remote_format("http://example.com/checks.json?team=db", "text/plain"),
+		"url extension is used for generic content types")
+}
+
+func TestLoadConfigRemote(t *testing.T) {
+	orig_first_run := first_run
+	first_run = func (i int64) (time.Time) { return time.Unix(42,0) }
+	defer func () { first_run = orig_first_run }()
+
+	dir, err := ioutil.TempDir("", "bmad-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &remote_server{
+		body:         "first:\n  command: echo \"remote first\"\nremote_check:\n  command: echo \"remote\"\n  every: 60\n",
+		content_type: "text/yaml",
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	cfg_file := dir + "/bmad.yml"
+	err = ioutil.WriteFile(cfg_file, []byte(fmt.Sprintf(`
+send_bolo: t/bin/send_bolo
+include_dir: t/data/bmad.empty
+remote:
+  url:   %s/checks
+  every: 5
+  cache: %s/remote
+log:
+  level: warning
+  type: file
+  file: /dev/null
+checks:
+  first:
+    command: echo "success"
+`, ts.URL, dir)), 0644)
+	assert.Nil(t, err)
+
+	cfg = nil // Reset cfg
+	got, err := LoadConfig(cfg_file)
+	assert.Nil(t, err, "LoadConfig() with a remote doesn't return an error")
+	assert.Equal(t, int64(MIN_INTERVAL), got.Remote.Every, "remote polling interval is at least MIN_INTERVAL")
+	assert.Equal(t, int64(10), got.Remote.Timeout, "remote timeout defaults to 10s")
+	assert.Equal(t, []string{"first", "remote_check"}, check_names(got.Checks), "remote checks are merged in")
+	assert.Equal(t, "echo \"success\"", got.Checks["first"].Command, "local checks take precedence over remote checks")
+	assert.Equal(t, []string{ts.URL + "/checks"}, got.Checks["remote_check"].Sources(), "remote checks are sourced from the url")
+	assert.Equal(t, int64(60), got.Checks["remote_check"].Every, "remote checks are initialized like local checks")
+
+	ts.Close()
+	reloaded, err := parse_config(cfg_file, true)
+	assert.Nil(t, err, "reloads use the applied remote document, without fetching it again")
+	assert.Equal(t, []string{"first", "remote_check"}, check_names(reloaded.Checks), "applied remote checks are kept on reload")
+	assert.Nil(t, reloaded.remote_err, "reloads using the applied remote document aren't degraded")
+
+	cfg = nil // Reset cfg
+	got, err = LoadConfig(cfg_file)
+	assert.Nil(t, err, "LoadConfig() with an unreachable remote doesn't return an error")
+	assert.Equal(t, []string{"first", "remote_check"}, check_names(got.Checks), "cached remote checks are used when the remote is unreachable")
+	assert.Error(t, got.remote_err, "configs using the cached remote document are degraded")
+
+	cfg = nil // Reset cfg
+	os.Remove(dir + "/remote")
+	got, err = LoadConfig(cfg_file)
+	assert.Nil(t, err, "LoadConfig() with an unreachable remote, and nothing cached, doesn't return an error")
+	assert.Equal(t, []string{"first"}, check_names(got.Checks), "remote checks are skipped if the remote can't be loaded")
+	cfg = nil // Reset cfg
+	_, err = parse_config(cfg_file, true)
+	if assert.Error(t, err, "reloads fail if the remote can't be loaded, and nothing is cached") {
+		assert.Contains(t, err.Error(), "Couldn't load checks from "+ts.URL+"/checks: ", "remote load errors are returned")
+	}
+}
+
+func Test_poll(t *testing.T) {
+	server := &remote_server{body: "check: { command: echo }\n", content_type: "text/yaml"}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// no cache, and no ETag, so polls can only compare the documents themselves
+	r := Remote{Url: ts.URL + "/poll", Timeout: 1}
+	_, _, applied, err := load_remote(r, nil, nil)
+	assert.Nil(t, err, "load_remote() doesn't return an error for a valid document")
+	p := &Poller{last: applied}
+
+	for i := 0; i < 2; i++ {
+		changed, err := p.poll(r)
+		assert.Nil(t, err, "poll() doesn't return an error for a valid document")
+		assert.False(t, changed, "poll() is false while the applied document is served")
+	}
+	assert.Nil(t, latest_remote(r.Url), "unchanged documents aren't kept")
+
+	server.body = "broken: "
+	changed, err := p.poll(r)
+	assert.Nil(t, err)
+	assert.True(t, changed, "poll() is true for new documents")
+	assert.Equal(t, "broken: ", string(latest_remote(r.Url).body), "new documents are kept for the reload to use")
+	changed, err = p.poll(r)
+	assert.Nil(t, err)
+	assert.False(t, changed, "poll() is only true once for each new document, even if it couldn't be loaded")
+
+	server.status = http.StatusInternalServerError
+	changed, err = p.poll(r)
+	assert.EqualError(t, err, "Unexpected response: 500 Internal Server Error", "poll() returns fetch errors")
+	assert.False(t, changed, "poll() is false when the endpoint fails")
+}
+
+func TestPollRemote(t *testing.T) {
+	assert.Nil(t, PollRemote(default_config(), func () {}), "PollRemote() returns nil without a remote url")
+
+	server := &remote_server{body: "check: { command: echo }\n", content_type: "text/yaml"}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	c := default_config()
+	c.Remote = Remote{Url: ts.URL, Every: 1, Timeout: 1}
+	notified := make(chan bool, 1)
+	p := PollRemote(c, func () {
+		select {
+		case notified <- true:
+		default:
+		}
+	})
+	defer p.Close()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Errorf("PollRemote() never called notify when the remote served a new document")
+	}
+}
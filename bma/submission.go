@@ -1,52 +1,120 @@
 package bma
 
 import "github.com/starkandwayne/goutils/log"
+import "errors"
+import "fmt"
 import "os"
 import "os/exec"
 import shellwords "github.com/mattn/go-shellwords"
+import "strconv"
+import "strings"
+import "sync"
 import "syscall"
 
 var writer *os.File
 var send2bolo *exec.Cmd
 
+// Serializes writes to send_bolo, since streaming checks submit
+// their output from their own goroutines, and guards send2bolo,
+// since exited send_bolo processes are reaped from their own goroutine
+var writer_lock sync.Mutex
+
 //FIXME: use zmq directly
 
 // Launches a child process to hold open a ZMQ connection
 // to the upstream bolo server (send_bolo should take care
-// of the configuration for how to connect). Upon termination
-// this process will be respawned.
+// of the configuration for how to connect).
 //
-// Currently, if the send_bolo configuration directive for bmad
-// is updated on a config reload, the send_bolo process will not
-// be respawned. A full-daemon restart is required to make use
-// of the new send_bolo configuration
+// If the send_bolo configuration directive for bmad is updated
+// on a config reload, ReloadConfig() will take care of replacing
+// the send_bolo process via reconnect_to_bolo()
 func ConnectToBolo() error {
-	args, err := shellwords.Parse(cfg.Send_bolo)
+	proc, w, err := spawn_submitter(cfg)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Spawning bolo submitter:  %#v", args)
-	send2bolo = exec.Command(args[0], args[1:]...)
-	r, w, err := os.Pipe()
+	writer_lock.Lock()
+	send2bolo = proc
+	writer = w
+	writer_lock.Unlock()
+	watch_submitter(proc)
+	return nil
+}
+
+// Replaces the current send_bolo process with a new one, based on
+// the send_bolo directive of c. The new process is spawned first, so
+// if that fails, the current send_bolo is left in place. Otherwise, the
+// current send_bolo gets an EOF, so it can flush anything it has buffered
+// before it exits.
+func reconnect_to_bolo(c *Config) error {
+	proc, w, err := spawn_submitter(c)
 	if err != nil {
 		return err
 	}
-	send2bolo.Stdin = r
+	writer_lock.Lock()
+	old := writer
+	send2bolo = proc
 	writer = w
-	err = send2bolo.Start()
-	if err != nil {
-		writer = nil
-		send2bolo = nil
-		return err
+	writer_lock.Unlock()
+	watch_submitter(proc)
+	if old != nil {
+		old.Close()
 	}
-	log.Debugf("send_bolo: %#v", send2bolo)
-	go func() { send2bolo.Wait(); send2bolo = nil }()
 	return nil
 }
 
+// Spawns a send_bolo process based on the send_bolo directive of c,
+// returning the process, and the pipe used to feed it data
+func spawn_submitter(c *Config) (*exec.Cmd, *os.File, error) {
+	args, err := shellwords.Parse(c.Send_bolo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil, errors.New("no send_bolo command specified")
+	}
+	log.Debugf("Spawning bolo submitter:  %s", mask_secrets(fmt.Sprintf("%#v", args), c.secrets))
+	proc := exec.Command(args[0], args[1:]...)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	proc.Stdin = r
+	err = proc.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	log.Debugf("Spawned bolo submitter send_bolo[%d]", proc.Process.Pid)
+	return proc, w, nil
+}
+
+// Reaps the send_bolo process once it exits, clearing send2bolo,
+// unless it has since been replaced by a new send_bolo process
+func watch_submitter(proc *exec.Cmd) {
+	go func() {
+		proc.Wait()
+		writer_lock.Lock()
+		defer writer_lock.Unlock()
+		if send2bolo == proc {
+			send2bolo = nil
+		}
+	}()
+}
+
+// Returns the running send_bolo process, or nil if it has exited
+func submitter() *exec.Cmd {
+	writer_lock.Lock()
+	defer writer_lock.Unlock()
+	return send2bolo
+}
+
 // Disconnects from bolo (terminates the send_bolo process)
 // If send_bolo is no longer running, does nothing.
 func DisconnectFromBolo() {
+	writer_lock.Lock()
+	defer writer_lock.Unlock()
 	if send2bolo == nil {
 		log.Warnf("Bolo disconnect requested, but send_bolo is not running")
 		return
@@ -61,9 +129,64 @@ func DisconnectFromBolo() {
 // Sends an individual message from check output to bolo,
 // via the send_bolo child process, spawned in ConnectToBolo()
 func SendToBolo(msg string) error {
+	writer_lock.Lock()
+	defer writer_lock.Unlock()
 	if _, err := writer.Write([]byte(msg)); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Checks that a line of check output is a well-formed bolo message, so
+// that streaming checks can't send garbage to bolo. Returns an error
+// describing the problem with the message, if any.
+func valid_message(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return errors.New("empty message")
+	}
+
+	var min, max int
+	switch fields[0] {
+	case "STATE":
+		min, max = 4, -1
+	case "COUNTER":
+		min, max = 3, 4
+	case "SAMPLE", "RATE":
+		min, max = 4, 4
+	case "EVENT":
+		min, max = 3, -1
+	case "KEY":
+		min, max = 2, -1
+	default:
+		return errors.New(fmt.Sprintf("unknown message type in %q", line))
+	}
+	if len(fields) < min || (max > 0 && len(fields) > max) {
+		return errors.New(fmt.Sprintf("wrong number of fields for %s in %q", fields[0], line))
+	}
+	if fields[0] == "KEY" {
+		return nil
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return errors.New(fmt.Sprintf("invalid timestamp in %q", line))
+	}
+	switch fields[0] {
+	case "STATE":
+		if code, err := strconv.Atoi(fields[3]); err != nil || code < OK || code > UNKNOWN {
+			return errors.New(fmt.Sprintf("invalid status code in %q", line))
+		}
+	case "COUNTER":
+		if len(fields) == 4 {
+			if _, err := strconv.ParseUint(fields[3], 10, 64); err != nil {
+				return errors.New(fmt.Sprintf("invalid increment in %q", line))
+			}
+		}
+	case "SAMPLE", "RATE":
+		if _, err := strconv.ParseFloat(fields[3], 64); err != nil {
+			return errors.New(fmt.Sprintf("invalid value in %q", line))
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package bma
 
 import "io/ioutil"
 import "os"
+import "github.com/starkandwayne/goutils/log"
 import "github.com/stretchr/testify/assert"
 import "testing"
 import "time"
@@ -23,6 +24,31 @@ func Test_SendToBolo(t *testing.T) {
 	assert.NoError(t, err, "No errors from reading")
 }
 
+func Test_spawn_submitter(t *testing.T) {
+	os.Mkdir("t/tmp", 0755)
+	os.Remove("t/tmp/debug.log")
+	log.SetupLogging(log.LogConfig{ Type: "file", File: "t/tmp/debug.log", Level: "debug" })
+	defer log.SetupLogging(log.LogConfig{ Type: "file", File: "/dev/null", Level: "warning" })
+
+	c := &Config{
+		Send_bolo: "t/bin/send_bolo --key hunter2",
+		secrets:   []string{"hunter2"},
+	}
+	os.Chmod("t/bin/send_bolo", 0755)
+	proc, w, err := spawn_submitter(c)
+	if !assert.NoError(t, err, "No error spawning send_bolo") {
+		return
+	}
+	w.Close()
+	proc.Wait()
+
+	logged, err := ioutil.ReadFile("t/tmp/debug.log")
+	assert.NoError(t, err, "No error reading the debug log")
+	assert.Contains(t, string(logged), "send_bolo", "spawning send_bolo is logged")
+	assert.Contains(t, string(logged), MASK, "secrets in send_bolo are masked in the debug log")
+	assert.NotContains(t, string(logged), "hunter2", "secrets in send_bolo never make it to the debug log")
+}
+
 func Test_LifeOfBolo(t *testing.T) {
 	cfg = &Config{
 		Send_bolo: "t/bin/not_send_bolo",
@@ -73,3 +99,33 @@ func Test_LifeOfBolo(t *testing.T) {
 	assert.NoError(t, err, "Able to read data from send_bolo output")
 	assert.Equal(t, "Test message\n", string(got), "Read in correct data from send_bolo output")
 }
+
+func Test_valid_message(t *testing.T) {
+	for _, msg := range []string{
+		"STATE 1234567890 host:check 0 all good\n",
+		"STATE 1234567890 host:check 3",
+		"COUNTER 1234567890 host:counter",
+		"COUNTER 1234567890 host:counter 5",
+		"SAMPLE 1234567890 host:sample 4.2",
+		"RATE 1234567890 host:rate 100",
+		"EVENT 1234567890 host:event something happened",
+		"KEY host:key=value",
+	} {
+		assert.NoError(t, valid_message(msg), "%q is a valid message", msg)
+	}
+
+	for msg, err := range map[string]string{
+		"":                                  "empty message",
+		"hello world":                       `unknown message type in "hello world"`,
+		"STATE 1234567890 host:check":       `wrong number of fields for STATE in "STATE 1234567890 host:check"`,
+		"STATE 1234567890 host:check 4 ok":  `invalid status code in "STATE 1234567890 host:check 4 ok"`,
+		"STATE now host:check 0 ok":         `invalid timestamp in "STATE now host:check 0 ok"`,
+		"COUNTER 1234567890 host:counter x": `invalid increment in "COUNTER 1234567890 host:counter x"`,
+		"SAMPLE 1234567890 host:sample":     `wrong number of fields for SAMPLE in "SAMPLE 1234567890 host:sample"`,
+		"SAMPLE 1234567890 host:sample NaN%": `invalid value in "SAMPLE 1234567890 host:sample NaN%"`,
+		"RATE 1234567890 host:rate 1 2":     `wrong number of fields for RATE in "RATE 1234567890 host:rate 1 2"`,
+		"KEY":                               `wrong number of fields for KEY in "KEY"`,
+	} {
+		assert.EqualError(t, valid_message(msg), err, "%q is an invalid message", msg)
+	}
+}
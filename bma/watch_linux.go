@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "github.com/starkandwayne/goutils/log"
+import "bytes"
+import "os"
+import "path/filepath"
+import "strings"
+import "syscall"
+import "time"
+import "unsafe"
+
+// inotify events that indicate a config file may have been
+// created, modified, renamed or removed
+const WATCH_EVENTS uint32 = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Watchers monitor the main config file, and the include_dir for
+// changes (via inotify), notifying bmad when a config reload is needed.
+type Watcher struct {
+	fd      int
+	inotify *os.File
+	filters map[int32]*watch_filter // files we care about, keyed by watch descriptor
+	events  chan bool
+}
+
+// Describes which changes to a watched directory are relevant
+type watch_filter struct {
+	patterns  []string // glob patterns of file names we care about
+	recursive bool     // are new subdirectories relevant too?
+}
+
+// Starts watching the directories containing cfg_file and the include_dir
+// and include patterns of c for changes. Once a burst of changes has settled for Watch_delay
+// seconds, notify is called. Only files that would be loaded by bmad
+// trigger notifications.
+func WatchConfig(cfg_file string, c *Config, notify func()) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		fd:      fd,
+		inotify: os.NewFile(uintptr(fd), "inotify"),
+		filters: map[int32]*watch_filter{},
+		events:  make(chan bool, 1),
+	}
+
+	if err := w.add(filepath.Dir(cfg_file), filepath.Base(cfg_file), false); err != nil {
+		w.inotify.Close()
+		return nil, err
+	}
+	for _, pattern := range include_patterns(c) {
+		for _, dir := range watch_dirs(pattern) {
+			if err := w.add(dir, filepath.Base(pattern), strings.Contains(pattern, "**")); err != nil {
+				log.Warnf("Couldn't watch %s for changes: %s", dir, err.Error())
+			}
+		}
+	}
+
+	delay := time.Duration(c.Watch_delay) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	go w.read()
+	go w.debounce(delay, notify)
+	return w, nil
+}
+
+// Returns the directories that need to be watched for files matching
+// an include pattern. Recursive (**) patterns require watching their
+// base directory, and every directory beneath it.
+func watch_dirs(pattern string) []string {
+	idx := strings.Index(pattern, "**")
+	if idx < 0 {
+		dirs, _ := glob(filepath.Dir(pattern))
+		return dirs
+	}
+
+	var dirs []string
+	filepath.Walk(filepath.Clean(pattern[:idx]), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs
+}
+
+// Stops watching for config changes
+func (w *Watcher) Close() {
+	w.inotify.Close()
+}
+
+// Adds an inotify watch on dir, for files matching pattern
+// (and subdirectories, if recursive)
+func (w *Watcher) add(dir string, pattern string, recursive bool) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, WATCH_EVENTS)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Watching %s/%s for config changes", dir, pattern)
+	filter, ok := w.filters[int32(wd)]
+	if !ok {
+		w.filters[int32(wd)] = &watch_filter{patterns: []string{pattern}, recursive: recursive}
+		return nil
+	}
+	// the same directory was added for multiple patterns
+	if !filter.matches(pattern) {
+		filter.patterns = append(filter.patterns, pattern)
+	}
+	filter.recursive = filter.recursive || recursive
+	return nil
+}
+
+// Does name match any of the filter's patterns?
+func (self *watch_filter) matches(name string) bool {
+	for _, pattern := range self.patterns {
+		if pattern == name {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads inotify events until the Watcher is closed, passing along
+// any events for files we care about to the debouncer
+func (w *Watcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_bytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(name_bytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			filter, ok := w.filters[event.Wd]
+			if !ok {
+				continue
+			}
+			// new subdirectories of recursive includes may contain new include files
+			new_dir := filter.recursive && event.Mask&syscall.IN_ISDIR != 0
+			if !filter.matches(name) && !new_dir {
+				continue
+			}
+			log.Debugf("Detected change to config file %s (event 0x%x)", name, event.Mask)
+			select {
+			case w.events <- true:
+			default: // a change is already pending
+			}
+		}
+	}
+}
+
+// Waits for bursts of events to settle for delay before calling notify
+func (w *Watcher) debounce(delay time.Duration, notify func()) {
+	var settled <-chan time.Time
+	for {
+		select {
+		case _, ok := <-w.events:
+			if !ok {
+				return
+			}
+			settled = time.After(delay)
+		case <-settled:
+			settled = nil
+			notify()
+		}
+	}
+}
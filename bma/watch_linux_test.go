@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package bma
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "io/ioutil"
+import "os"
+import "time"
+
+// Waits up to timeout for the watcher to send a notification
+func wait_for_notify(notified chan bool, timeout time.Duration) bool {
+	select {
+	case <-notified:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmad-watch")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/bmad.d", 0755)
+	ioutil.WriteFile(dir+"/bmad.conf", []byte("checks: {}\n"), 0644)
+
+	notified := make(chan bool, 10)
+	c := &Config{ Include_dir: dir + "/bmad.d", Watch_delay: 1 }
+	w, err := WatchConfig(dir+"/bmad.conf", c, func () { notified <- true })
+	if !assert.NoError(t, err, "No errors watching config files") {
+		return
+	}
+	defer w.Close()
+
+	var settled time.Time
+	for _, name := range []string{"a.conf", "b.conf", "c.conf", "a.conf"} {
+		time.Sleep(100 * time.Millisecond)
+		settled = time.Now()
+		ioutil.WriteFile(dir+"/bmad.d/"+name, []byte("check: {}\n"), 0644)
+	}
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "a burst of changes results in a notification")
+	assert.True(t, time.Since(settled) >= time.Second, "no notification until changes have settled")
+	assert.False(t, wait_for_notify(notified, 1500 * time.Millisecond), "a burst of changes results in a single notification")
+
+	ioutil.WriteFile(dir+"/bmad.d/README", []byte("not a config\n"), 0644)
+	ioutil.WriteFile(dir+"/other.conf", []byte("not our config\n"), 0644)
+	assert.False(t, wait_for_notify(notified, 1500 * time.Millisecond), "changes to files bmad wouldn't load are ignored")
+
+	ioutil.WriteFile(dir+"/bmad.d/e.json", []byte("{}\n"), 0644)
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "json, toml, and yaml files in the include_dir are watched too")
+
+	os.Rename(dir+"/bmad.d/b.conf", dir+"/bmad.d/b.conf.disabled")
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "renaming an include file away triggers a notification")
+
+	ioutil.WriteFile(dir+"/bmad.conf.tmp", []byte("checks: { new: { command: test } }\n"), 0644)
+	os.Rename(dir+"/bmad.conf.tmp", dir+"/bmad.conf")
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "replacing the main config triggers a notification")
+
+	w.Close()
+	ioutil.WriteFile(dir+"/bmad.d/d.conf", []byte("check: {}\n"), 0644)
+	assert.False(t, wait_for_notify(notified, 1500 * time.Millisecond), "no notifications after the watcher is closed")
+
+	_, err = WatchConfig(dir+"/nonexistent/bmad.conf", c, func () {})
+	assert.Error(t, err, "watching a config in a nonexistent directory fails")
+}
+
+func TestWatchConfigRecursive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmad-watch")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/bmad.d/team1", 0755)
+	ioutil.WriteFile(dir+"/bmad.conf", []byte("checks: {}\n"), 0644)
+
+	notified := make(chan bool, 10)
+	c := &Config{ Include: []string{dir + "/bmad.d/**/*.yml"}, Watch_delay: 1 }
+	w, err := WatchConfig(dir+"/bmad.conf", c, func () { notified <- true })
+	if !assert.NoError(t, err, "No errors watching config files") {
+		return
+	}
+	defer w.Close()
+
+	ioutil.WriteFile(dir+"/bmad.d/team1/checks.yml", []byte("check: {}\n"), 0644)
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "changes in subdirectories of recursive includes are noticed")
+
+	ioutil.WriteFile(dir+"/bmad.d/team1/checks.conf", []byte("check: {}\n"), 0644)
+	assert.False(t, wait_for_notify(notified, 1500 * time.Millisecond), "files not matching the include pattern are ignored")
+
+	os.Mkdir(dir+"/bmad.d/team2", 0755)
+	assert.True(t, wait_for_notify(notified, 10 * time.Second), "new subdirectories of recursive includes are noticed")
+}
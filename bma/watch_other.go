@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package bma
+
+import "errors"
+
+// Watchers monitor the config files for changes. They are
+// only supported on Linux (via inotify).
+type Watcher struct{}
+
+// Config watching requires inotify, and is unsupported on this platform
+func WatchConfig(cfg_file string, c *Config, notify func()) (*Watcher, error) {
+	return nil, errors.New("watching config files for changes is only supported on Linux")
+}
+
+// Stops watching for config changes
+func (w *Watcher) Close() {}
@@ -38,21 +38,93 @@
 //	retry_every: 60                     # Default interval to retry failed checks (in seconds)
 //	retries:     1                      # Default number of times to retry failed checks before submitting results
 //	timeout:     45                     # Default maximum execution time (in seconds) of a check
-//	bulk:        false                  # Default for is this check a bulk check? (must be "true" to enable)
-//	report:      false                  # Default for automatically report status of the bulk check execution? (must be "true" to enable)
+//	bulk:        false                  # Default for is this check a bulk check?
+//	report:      false                  # Default for automatically report status of the bulk check execution?
+//	exit_state:  false                  # Default for report the exit code of non-bulk checks as a STATE?
 //	env:         {}                     # Hash of environment variables to set when running checks
 //	host:        <local FQDN>           # hostname that bmad is running on (will auto-detect FQDN if possible)
 //	include_dir: /etc/bmad.d            # Directory to load additional check configurations from
+//	include:     []                     # List of additional files, directories, or glob patterns to load check configurations from
+//	on_duplicate: first                 # How to handle checks defined in multiple files: first, last, merge, or error
+//	watch:       false                  # Automatically reload the config when config files change (Linux only)
+//	watch_delay: 2                      # Time to wait for a burst of config file changes to settle before reloading (in seconds)
 //	checks:      {}                     # Hash of checks to run
+//	templates:   {}                     # Hash of check templates, for checks to inherit from (see TEMPLATES)
+//	plugins:     {}                     # Hash of long-lived plugins, for checks to be run via (see PLUGINS)
+//	limits:      {}                     # Default resource limits for checks (see RESOURCE LIMITS)
+//	cgroup:      {}                     # Default cgroup settings for checks (see RESOURCE LIMITS)
+//	max_output:  0                      # Default maximum standard output to capture from checks (in bytes, 0 for no limit)
+//	max_stderr:  0                      # Default maximum standard error to capture from checks (in bytes, 0 for no limit)
+//	remote:
+//		url:       ""                     # HTTP(S) URL to fetch additional check configurations from (see REMOTE CONFIGS)
+//		every:     300                    # Interval to poll the URL for changes (in seconds)
+//		timeout:   10                     # Maximum time to wait for the URL to respond (in seconds)
+//		cache:     /var/cache/bmad/remote # File to cache the last good copy of the remote config in
 //	log:
 //		type:      console                # Specifies whether to log to stdout/console, syslog, or file
 //		level:     debug                  # Log level to use (debug, info, notice, warn, err, etc)
 //		facility:  daemon                 # syslog facility (only used in syslog mode)
 //		file:      ""                     # File name to log to (only used in file mode)
 //
-// Any files ending in '.conf' in the include_dir directory will be automatically loaded as additional
-// hashes of check configurations, which are merged in with any found in the main config file. If there
-// are any duplicate check names found, the earliest seen takes precedence.
+// bmad will reload its configuration upon receiving a SIGHUP. If watch is enabled, bmad will also watch the main
+// config file, the include_dir, and any include paths for changes, and reload automatically, once any changes have settled for
+// watch_delay seconds. Reloads keep the state of any checks that are still configured (scheduling, retry attempts,
+// etc.). Reloads are transactional: the new configuration is fully loaded and validated, and if send_bolo
+// has changed, the new send_bolo is spawned, before anything is swapped in. If any of that fails, bmad keeps
+// running with its current configuration and bolo connection. Unlike at startup, where invalid checks, plugins,
+// and unparseable include files are logged and skipped, any invalid check, plugin, or include fails the whole
+// reload. The outcome of each reload is sent to bolo as a STATE for <host>:bmad:reload.
+//
+// Any files ending in '.conf', '.json', '.toml', '.yml', or '.yaml' in the include_dir directory will be
+// automatically loaded as additional hashes of check configurations, which are merged in with any found in the
+// main config file. The include directive can list more files, directories (whose files with those extensions
+// are loaded), or glob patterns to load check configurations from. Glob patterns may use '**' to match any
+// number of subdirectories, e.g. /etc/bmad.d/**/*.yml. Files are loaded in a deterministic order: the
+// include_dir first, followed by each include entry in turn, with the files matched by each entry sorted by path.
+//
+// The on_duplicate directive determines what happens when the same check name is found in multiple files:
+//
+//	first    the earliest definition seen takes precedence, and later ones are ignored (the default)
+//	last     the latest definition seen replaces any earlier ones
+//	merge    directives set in later definitions override those of earlier ones, allowing overlay files
+//	         to change a single directive of a packaged check (env hashes are merged key by key)
+//	error    duplicate definitions are a configuration error, and the config will fail to load
+//
+// The file(s) each check was defined in are logged at debug level, and shown in --test mode.
+//
+// Config files may be written in YAML, JSON, or TOML. The format is determined by the file's extension:
+// '.json' files are parsed as JSON, '.toml' files as TOML, and everything else ('.yml', '.yaml', and
+// '.conf' files) as YAML. The directives, defaults, and validation are the same regardless
+// of format, so tools that emit JSON can generate check configs to be picked up via the include directive:
+//
+//	{ "disk_usage": { "command": "/usr/lib/bolo/collectors/df", "every": 60 } }
+//
+// Each included file may also provide defaults for the checks it contains, under a top-level 'defaults'
+// key. These accept the same directives as a check (every, env, run_as, etc.), and apply only to the checks
+// in that file. Values are taken from the check first, then its template, then the file's defaults, and
+// lastly the global defaults. This allows each team to own a subdirectory of checks, with its own defaults:
+//
+//	defaults:
+//		every:  60
+//		run_as: dba
+//		env:    { PGHOST: localhost }
+//	pg_replication:
+//		command: /usr/lib/bolo/collectors/pg-replication
+//
+// REMOTE CONFIGS
+//
+// bmad can also fetch check configurations from a central HTTP(S) service, by setting remote.url. The
+// document served is treated like an included file (a hash of checks, with optional 'templates' and
+// 'defaults' keys), and is loaded after the include_dir and include files. Its format is determined by
+// the Content-Type of the response (YAML, JSON, or TOML), falling back to the extension in the URL.
+//
+// The last good copy of the document is cached on disk, and requests are made conditional on its ETag
+// and Last-Modified headers, so unchanged documents aren't re-downloaded. If the service is unreachable,
+// or serves a document that can't be parsed, bmad falls back to the last good copy. Every remote.every seconds,
+// bmad polls the URL, and reloads its configuration if a different document is being served than the last one
+// it saw. Reloads use the document fetched by the poll (or the one already loaded, for reloads triggered by a
+// SIGHUP or file changes), rather than fetching it again. A reload that has to fall back to the last good copy is
+// reported as a WARNING, and one where the document can't be loaded at all, with nothing cached, fails.
 //
 // CHECKS
 //
@@ -72,20 +144,298 @@
 // Checks share many directives as the main config file, to override the global defaults. Any check-specific
 // settings take precedence over the global values (since that's generally what one would expect of an override).
 // For the case of environment variables, the hash of environment variables is merged together, with any
-// conflicts being chosen in favor of the check-specific value. Below are all the available check configuration
-// directives:
+// conflicts being chosen in favor of the check-specific value. The bulk and report directives accept
+// YAML booleans (true/false/yes/no), as well as their quoted string equivalents. A check that leaves
+// them unset inherits the global default, while an explicit false overrides it. Values that aren't booleans
+// are configuration errors: the check is skipped, or for the global defaults, the whole config fails to load.
+// Enabling report on a non-bulk check is a configuration error, and the check will be skipped.
+//
+// Non-bulk checks that only print SAMPLEs or COUNTERs can have their exit code reported as a STATE for
+// <host>:bmad:<check> by enabling exit_state, using the first line of their output as the message (prefixed
+// with how the check was terminated, if it didn't exit normally). As with the check's output, the STATE is
+// only sent once the check succeeds, or has used up its retries. Enabling exit_state on a bulk check is a
+// configuration error (use report instead). Below are all the available check configuration directives:
 //
 //	my_check:                             # name of the check
 //		command:     /path/to/cmd --args    # command to run
+//		builtin:     ""                     # builtin check to run instead of a command (see BUILTIN CHECKS)
+//		plugin:      ""                     # plugin to run the check via, instead of a command (see PLUGINS)
+//		params:      {}                     # Hash of parameters for the builtin check, or to pass to the plugin
 //		every:       300                    # Interval to run this check (in seconds)
 //		retries:     1                      # Number of times to retry after failure, before submitting results
 //		retry_every: 60                     # Interval to retry the check after failure
 //		timeout:     45                     # Maximum execution time (in seconds) of the check
+//		timeout_signal: SIGTERM             # Signal to send the check when it times out (SIGINT, SIGTERM, SIGQUIT, SIGHUP, etc.)
+//		kill_after:  2                      # Time to wait after the timeout signal before sending SIGKILL (in seconds, 0 for no wait)
+//		report_timeout: false               # Send an UNKNOWN STATE for <host>:bmad:<check> as soon as the check times out?
+//		allow_long_timeout: false           # Allow timeout to exceed retry_every?
 //		env:         {}                     # Hash of environment variables to set for the check
 //		run_as:      root                   # User to run the check as (defaults to the user running bmad)
-//		bulk:        false                  # Is this check a bulk check? See CHECKS for details (must be "true" to enable)
-//		report:      false                  # Automatically report status of the bulk check execution? (must be "true" to enable)
+//		run_as_group: root                  # Group (name or gid) to run the check as (defaults to the run_as user's primary group)
+//		bulk:        false                  # Is this check a bulk check? See CHECKS for details
+//		report:      false                  # Automatically report status of the bulk check execution? (bulk checks only)
+//		exit_state:  false                  # Report the exit code of the check as a STATE? (non-bulk checks only)
+//		stream:      false                  # Send each line of output to bolo as soon as it's written? (bulk checks only)
+//		mode:        scheduled              # Run the check every interval (scheduled), or continuously (persistent, see PERSISTENT CHECKS)
+//		exit_codes:  {}                     # Hash of exit codes to the states they represent (OK, WARNING, CRITICAL, or UNKNOWN)
+//		signal_rc:   UNKNOWN                # State to use when the check is killed by a signal
 //		name:        my_check               # Override the name specified by the key of this check
+//		use:         my_template            # Template to inherit any unset directives from (see TEMPLATES)
+//		foreach:     []                     # List of values to generate one check per value from (see GENERATED CHECKS)
+//		glob:        ""                     # Glob pattern to generate one check per matching path from (see GENERATED CHECKS)
+//		cwd:         /                      # Working directory to run the check from (must be an absolute path)
+//		umask:       ""                     # Umask to run the check with, in octal, e.g. 022 (defaults to bmad's umask)
+//		stdin:       ""                     # Data to send to the check's standard input, or file:/path/to/file to send a file's contents
+//		limits:      {}                     # Resource limits for the check (see RESOURCE LIMITS)
+//		cgroup:      {}                     # cgroup settings for the check (see RESOURCE LIMITS)
+//		max_output:  0                      # Maximum standard output to capture from the check (in bytes, 0 for no limit)
+//		max_stderr:  0                      # Maximum standard error to capture from the check (in bytes, 0 for no limit)
+//
+// Each check is run in its own process group. Checks that exceed their timeout are sent their timeout_signal
+// (SIGTERM by default), followed by a SIGKILL kill_after seconds later if they're still running, and these signals
+// are sent to the whole process group, so that anything the check spawned (curl, ssh, etc.) is terminated along
+// with it. If report_timeout is enabled, an UNKNOWN STATE is sent to bolo as soon as the timeout signal is sent,
+// rather than waiting for the check to be reaped. Once a check exits,
+// the number of processes it left running in its process group is sent to bolo as a SAMPLE for
+// <host>:bmad:<check>:orphans. Leftovers of checks that timed out are killed. Each timeout is counted via a
+// COUNTER for <host>:bmad:<check>:timeouts. When a bulk check with report enabled fails, its STATE message
+// starts with how it was terminated, if it didn't exit normally, e.g. "(timed out after 45s, killed by SIGKILL)",
+// or "(killed by SIGHUP)" for signals sent from outside of bmad, followed by its standard error.
+//
+// Bulk checks that run for a long time, or emit data continuously, can enable stream. Each line the check writes
+// to its standard output is then sent to bolo as soon as it's complete, rather than once the check exits. Lines that
+// aren't valid bolo messages (STATE, COUNTER, SAMPLE, RATE, EVENT, or KEY) are logged and dropped. The meta-stats
+// for the check (and its STATE, if report is enabled) are still sent when it exits. In --test mode, the output
+// of streaming checks is buffered, so that it can be displayed.
+//
+// To keep a misbehaving check from using up bmad's memory, the output captured from it can be limited via max_output
+// and max_stderr. Once a check has written that many bytes, the rest of its output is read and discarded, any
+// partial line left at the end of its standard output is dropped, and a COUNTER for <host>:bmad:<check>:output-truncated
+// is sent to bolo. For streaming checks, max_output limits the length of each line instead, and longer lines are dropped.
+//
+// To keep checks from piling up, timeouts are normally limited to less than retry_every. Checks that
+// legitimately need to run longer than their interval can set allow_long_timeout, in which case the next run
+// is delayed until the current one finishes (or times out).
+//
+// By default, a check's exit code is its state, following the Nagios convention (0 is OK, 1 WARNING, 2 CRITICAL,
+// and 3 UNKNOWN), and checks that exit with any other code, or are killed by a signal, are UNKNOWN. Checks with
+// their own conventions can map their exit codes to states via exit_codes, and choose the state for signal deaths
+// via signal_rc. Exit codes that aren't mapped keep their usual meaning:
+//
+//	vendor_check:
+//		command:    /opt/vendor/bin/check_raid
+//		exit_codes: { 0: OK, 4: WARNING, 255: CRITICAL }
+//		signal_rc:  CRITICAL
+//
+// The raw exit code of each run is sent to bolo as a SAMPLE for <host>:bmad:<check>:exit-code, or, if the check
+// was killed by a signal, the signal number is sent as a SAMPLE for <host>:bmad:<check>:signal.
+//
+// Checks run via run_as or run_as_group keep all of the user's supplementary groups (e.g. adm, docker),
+// and have HOME, USER, and LOGNAME set to match the user, unless overridden via env.
+//
+// Checks without a stdin directive have their standard input connected to /dev/null. Files given via
+// stdin: file:/path are opened each time the check is run, so changes to them are picked up without
+// a reload. Since YAML treats numbers with a leading zero as octal, umask may be given as 022 or "022" (JSON and TOML
+// configs should use the quoted form).
+//
+// PERSISTENT CHECKS
+//
+// Some collectors (log tailers, event listeners, etc.) are meant to run forever, printing metrics as they go.
+// These can be run with mode: persistent. Persistent checks are started as soon as bmad starts, and are always
+// treated as bulk checks with stream enabled, so each line they write is sent to bolo right away. Anything
+// they write to standard error is logged. They have no timeout, and every controls how often their uptime is
+// sent to bolo, as a SAMPLE for <host>:bmad:<check>:uptime (in seconds):
+//
+//	tail_nginx:
+//		command: /usr/lib/bolo/collectors/tail-nginx /var/log/nginx/access.log
+//		mode:    persistent
+//		every:   60
+//
+// If a persistent check exits, it is restarted, and a COUNTER for <host>:bmad:<check>:restarts is sent to bolo.
+// Checks that keep exiting are restarted after a delay, starting at 1 second, and doubling with each restart,
+// up to 5 minutes. Once a check has stayed up for longer than that, it is restarted right away the next time
+// it exits. When bmad shuts down, or a persistent check is removed from the config (or its command changes), the
+// check is sent its timeout_signal, followed by SIGKILL kill_after seconds later if it hasn't exited. In --test
+// mode, persistent checks are stopped once they have run for their timeout, so that their output can be displayed.
+//
+// BUILTIN CHECKS
+//
+// Common system checks and network probes can be run natively by bmad, without forking a collector (or
+// depending on tools like curl being installed), by setting builtin instead of command. Builtins report a
+// STATE for <host>:<check>, along with SAMPLEs for <host>:<check>:<metric>, and are retried and timed out
+// like any other check. Thresholds are given via params, and states are the worse of any thresholds crossed.
+// Unset thresholds are ignored, unless they have a default (an explicit 0 is a threshold like any other):
+//
+//	disk      mounts (comma-separated, defaults to all block devices), warn (80), crit (90): percentage of
+//	          space used on each mount (used-pct, total-bytes, used-bytes, and free-bytes per mount, named
+//	          after the mount point, with / as root, and /var/log as var-log)
+//	load      warn, crit: 1-minute load average (load1, load5, and load15)
+//	memory    warn (90), crit (95), swap_warn, swap_crit: percentage of memory and swap used (memory-used-pct,
+//	          memory-total-bytes, memory-available-bytes, swap-used-pct, swap-total-bytes, and swap-free-bytes)
+//	process   name (required), min (1), max: number of running processes with the given name (count)
+//	file      path (required), warn_age, crit_age (in seconds), warn_size, crit_size (in bytes): age and size
+//	          of a file, which is CRITICAL if missing (age and size)
+//	tcp       host (required), port (required), warn, crit (in seconds): time taken to connect to the port,
+//	          which is CRITICAL if the connection fails (latency)
+//	http      url (required), status, match, insecure, warn, crit (in seconds), cert_warn (30), cert_crit (7):
+//	          time taken to fetch the url, which is CRITICAL if the status isn't the expected one (any error
+//	          status, if unset), or the body doesn't match the match regex. For HTTPS urls, the certificate is
+//	          verified (unless insecure is set), and checked for how many days remain until it expires (latency,
+//	          status, and cert-expiry-days)
+//	dns       name (required), type (A), server, expect, warn, crit (in seconds): time taken to resolve the
+//	          name as an A, AAAA, CNAME, MX, NS, or TXT record, via server (host or host:port, defaults to the
+//	          system resolver), which is CRITICAL if it can't be resolved, or any of the answers in expect
+//	          (comma-separated) weren't returned (latency and answers)
+//
+//	root_disk:
+//		builtin: disk
+//		params:  { mounts: "/,/var", warn: 70, crit: 85 }
+//	nginx_running:
+//		builtin: process
+//		params:  { name: nginx, min: 2 }
+//	api_health:
+//		builtin: http
+//		params:  { url: "https://api.example.com/health", match: "\"status\": ?\"ok\"", crit: 2 }
+//
+// Network probes (tcp, http, and dns) give up a second before the check's timeout (or halfway through, for
+// timeouts of 2s or less), so that they report their own failures. The http builtin follows redirects, and
+// honors the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables of bmad.
+//
+// Builtins run inside bmad, so process-related directives (run_as, cwd, limits, cgroup, etc.) don't apply to
+// them, and exit_state is ignored. Builtins that hang past their timeout are abandoned, and reported as UNKNOWN.
+// Unknown builtins or params, and non-numeric thresholds, are configuration errors. Builtins cannot be persistent.
+// The disk builtin is only supported on Linux.
+//
+// PLUGINS
+//
+// Collectors with expensive startup costs (e.g. interpreters importing heavy libraries) can be run as
+// plugins: long-lived processes that bmad launches once, and asks to run checks on their usual schedule.
+// Plugins are defined in the main config file, and checks are run via a plugin by setting plugin instead
+// of command. The check's params are passed along to the plugin:
+//
+//	plugins:
+//		python:
+//			command: /usr/lib/bolo/plugins/python-collectors
+//			env:     { PYTHONPATH: /usr/lib/bolo/python }
+//	checks:
+//		pg_replication:
+//			plugin: python
+//			params: { database: main }
+//
+// bmad talks to each plugin over its standard input and output, one JSON-RPC 2.0 message per line. Each run
+// of a check is sent as a request, which the plugin answers (in any order) with the rc and output of the run:
+//
+//	{"jsonrpc":"2.0","id":1,"method":"run","params":{"check":"pg_replication","params":{"database":"main"},"timeout":45}}
+//	{"jsonrpc":"2.0","id":1,"result":{"rc":0,"output":"SAMPLE 1234567890 db01:pg:lag 0.2\n"}}
+//
+// The rc and output are handled exactly like the exit code and standard output of a check's command, so retries,
+// bulk, report, exit_state, and exit_codes all apply. A plugin that can't run a check can reply with an error
+// instead, e.g. {"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"database unreachable"}}, in which case
+// the check is UNKNOWN, and the message is treated as its standard error. Checks that get no reply within their
+// timeout are UNKNOWN, and any later reply is discarded. Anything a plugin writes to its standard error is logged.
+//
+// Plugins are launched the first time one of their checks is run. If a plugin exits, the checks it was running
+// are UNKNOWN, and it's relaunched the next time one of its checks is run. Plugins that are removed from the config
+// (or whose command or env changes) are stopped on reload, as are all plugins when bmad shuts down, by closing their
+// standard input, and sending SIGTERM to their process group, followed by SIGKILL if they're still running kill_after
+// seconds later (2 by default, set per plugin alongside command and env). Plugins inherit the global env, and their
+// command and env may use INTERPOLATION. Process-related check directives (run_as, limits, cgroup, etc.) don't apply to checks
+// run via plugins, and plugin checks cannot be persistent.
+//
+// RESOURCE LIMITS
+//
+// To keep a runaway check from starving the services it's monitoring, checks can be run with resource
+// limits and reduced priorities. Limits are applied to the check's process before its command is executed,
+// and are inherited by anything it spawns. Limits can be set globally, in templates, and per-file defaults,
+// as well as on the checks themselves. Each limit is inherited individually, so a check can override a
+// single limit. Limits that are not set anywhere are left alone (inheriting bmad's own limits):
+//
+//	limits:
+//		address_space: 512                # Maximum virtual memory size of the process (in megabytes)
+//		cpu_time:      30                 # Maximum CPU time (in seconds), after which the check is sent SIGXCPU, then SIGKILL
+//		open_files:    256                # Maximum number of open file descriptors
+//		processes:     64                 # Maximum number of processes for the user the check runs as
+//		nice:          10                 # Scheduling priority, from -20 (highest) to 19 (lowest)
+//		ionice:        best-effort:7      # I/O scheduling class and level: idle, best-effort[:0-7], or realtime[:0-7]
+//
+// Limits are applied by the user that the check runs as, so checks using run_as can only lower their limits
+// below bmad's own, and cannot increase their priority. If the limits cannot be applied, the check exits
+// UNKNOWN, with the reason on its standard error. Resource limits are only supported on Linux.
+//
+// On Linux systems using cgroup v2, checks can also be placed in cgroups, limiting the CPU and memory
+// available to a check (and everything it spawns), or to a group of checks as a whole. Each check is run in
+// its own cgroup (<root>/<group>/<check name>), beneath a cgroup for its group, which holds the limits:
+//
+//	cgroup:
+//		root:       /sys/fs/cgroup/bmad   # cgroup v2 directory to create check cgroups in (cgroups are disabled if unset)
+//		group:      collectors            # Name of the cgroup to share with other checks (defaults to the check name)
+//		cpu_max:    "50000 100000"        # CPU bandwidth for the group, as '<quota> <period>' in microseconds (or max)
+//		memory_max: 256M                  # Memory limit for the group, in bytes, or with a K, M, or G suffix (or max)
+//
+// The root must be writable by bmad, and cannot contain any processes itself (e.g. a cgroup delegated to bmad
+// by systemd, with bmad running in a child cgroup). After each run of a check placed in a cgroup, its CPU time
+// and peak memory usage are sent to bolo as SAMPLEs for <host>:bmad:<check>:cpu-time (in seconds) and
+// <host>:bmad:<check>:memory-peak (in bytes), alongside <host>:bmad:<check>:exec-time. If the cgroups cannot be
+// created, or the kernel cannot spawn processes into them, bmad logs a warning and runs the check without them.
+//
+// TEMPLATES
+//
+// When many checks differ only in their arguments, the directives they share can be defined once
+// as a template, under the 'templates' key. Templates accept all of the same directives as checks,
+// and checks opt in to a template via 'use'. Any directive left unset on the check is taken from its
+// template, and then from the global defaults. Templates may themselves 'use' other templates, and
+// environment variables are merged at every level, favoring the most specific value:
+//
+//	templates:
+//		http:
+//			command: /usr/lib/bolo/collectors/http --url http://localhost
+//			every:   60
+//			env:     { TIMEOUT: 10 }
+//		https:
+//			use:     http
+//			command: /usr/lib/bolo/collectors/http --url https://localhost
+//	checks:
+//		web:
+//			use:     https
+//			timeout: 30
+//
+// Files in the include_dir may also define templates, under a top-level 'templates' key. As with checks,
+// the earliest definition of a template takes precedence.
+//
+// GENERATED CHECKS
+//
+// A single check definition can be expanded into several checks, using either a 'foreach' list of values,
+// or a 'glob' pattern matching paths on the local filesystem. Each value is substituted for {{item}} in the
+// check's name, command, env, and params values (including any inherited from its template or file defaults).
+// The check name must contain {{item}}, so that each generated check has a unique name. Generated checks are named like any other check, so they can be filtered via --match
+// in --test mode. If a generated check has the same name as an explicitly defined check, the explicit check
+// wins.
+//
+//	disk_{{item}}:
+//		command: /usr/lib/bolo/collectors/disk --mount /{{item}}
+//		foreach: [ var, home, srv ]
+//	log_{{item}}:
+//		command: /usr/lib/bolo/collectors/logsize {{item}}
+//		glob:    /var/log/*.log
+//
+// INTERPOLATION
+//
+// Check commands, check env values (including the global env), check params, plugin commands and env values,
+// and send_bolo may reference environment variables and files, which are resolved whenever the config is
+// loaded or reloaded:
+//
+//	${NAME}                  # value of the NAME environment variable (it is an error if NAME is unset)
+//	${default:NAME:value}    # value of the NAME environment variable, or 'value' if NAME is unset
+//	${file:/path/to/file}    # contents of the file, minus any trailing newlines
+//
+// Values read from files are treated as secrets, and are masked when logging check definitions, so passwords
+// and API keys can be kept out of the config files themselves. Use $${ to pass a literal ${ through to the
+// check. Checks that reference unset variables, or unreadable files, are skipped.
+//
+//	db_health:
+//		command: /usr/lib/bolo/collectors/postgres --user ${default:PGUSER:monitor}
+//		env:
+//			PGPASSWORD: ${file:/etc/bmad/secrets/db_password}
 //
 // For proper retry and status submission, checks must exit with an exit code that indicates its STATE,
 // according to the following values:
@@ -145,6 +495,10 @@ const TICK time.Duration = 100 * time.Millisecond
 var cfg *bma.Config
 
 func main() {
+	// checks with resource limits or a umask are spawned via bmad, which
+	// applies them and execs the check (see bma.ExecWithLimits)
+	bma.ExecWithLimits()
+
 	// goroutines != threads. They're concurrent tasks inside of the go schedule
 	// Unless you adjust GOMAXPROCS, you will default to 1 CPU/1 thread, so only
 	// one goroutine can run at atime, leading to non-concurrent check running
@@ -205,6 +559,7 @@ func main() {
 			run_once(check)
 
 		}
+		bma.StopPlugins()
 		fmt.Printf("---------------------------\n")
 		fmt.Printf("Found and ran %d checks matching `%s`\n", ran, getopt.GetValue("match"))
 		fmt.Printf("---------------------------\n")
@@ -216,13 +571,23 @@ func main() {
 func run_once(check *bma.Check) {
 	fmt.Printf("---------------------------\n")
 	fmt.Printf("Executing %s in --test mode\n", check.Name)
+	fmt.Printf("Defined in %s\n", strings.Join(check.Sources(), ", "))
 	fmt.Printf("---------------------------\n")
+	// buffer the output of streaming checks, so it can be displayed
+	check.Stream = bma.TOGGLE_OFF
 	if err := check.Spawn(); err != nil {
-		fmt.Printf("Error executing %s: %s", check.Name, err.Error())
+		// nothing was started, so there's nothing to reap
+		fmt.Printf("Error executing %s: %s\n\n", check.Name, err.Error())
+		return
 	}
+	started := time.Now()
 	complete := check.Reap()
 	for !complete {
 		time.Sleep(TICK)
+		// persistent checks would run forever, so stop them after their timeout
+		if check.Persistent() && time.Since(started) > time.Duration(check.Timeout)*time.Second {
+			check.Stop()
+		}
 		complete = check.Reap()
 	}
 	fmt.Printf("Results:\n")
@@ -263,29 +628,34 @@ func run_loop() {
 			}
 		}
 	}()
+	watcher := watch_config(nil, &CFG_RELOAD)
+	poller := poll_remote(nil, &CFG_RELOAD)
 
 	for {
 		if SHUTDOWN {
 			log.Infof("Shutdown requested")
+			if watcher != nil {
+				watcher.Close()
+			}
+			if poller != nil {
+				poller.Close()
+			}
+			stop_persistent(in_flight)
+			bma.StopPlugins()
 			bma.DisconnectFromBolo()
 			break
 		}
 		if CFG_RELOAD {
 			log.Infof("Configuration reload requested")
-			var err error
-			cfg, err = bma.LoadConfig(getopt.GetValue("config"))
-			if err != nil {
-				log.Errorf("Couldn't reload config: %s", err.Error())
-			}
 			CFG_RELOAD = false
-			time.Sleep(250 * time.Millisecond) // make sure any buffers get read/sent/cleared for send_bolo
-			bma.DisconnectFromBolo()
-			err = bma.ConnectToBolo()
-			if err != nil {
-				log.Errorf("Couldn't spawn send_bolo: %s", err.Error())
-				panic(fmt.Sprintf("Couldn't spawn send_bolo: %s", err.Error()))
+			if new_cfg, err := bma.ReloadConfig(getopt.GetValue("config")); err != nil {
+				log.Errorf("Couldn't reload config, keeping current config: %s", err.Error())
+			} else {
+				cfg = new_cfg
+				in_flight = adopt_in_flight(in_flight)
+				watcher = watch_config(watcher, &CFG_RELOAD)
+				poller = poll_remote(poller, &CFG_RELOAD)
 			}
-
 		}
 		if CFG_DUMP {
 			log.Infof("Configuration dump requested")
@@ -322,3 +692,83 @@ func run_loop() {
 		time.Sleep(TICK)
 	}
 }
+
+// After a config reload, swaps any in-flight checks for their counterparts
+// in the new config (which took over their running processes when the config
+// was reloaded), so that their results are recorded against the checks that
+// will be scheduled going forward. Checks that were removed from the config
+// are reaped as-is. Persistent checks that were removed, or whose command has
+// changed, are stopped (changed checks are restarted once they exit).
+func adopt_in_flight(in_flight [](*bma.Check)) [](*bma.Check) {
+	var adopted [](*bma.Check)
+	for _, old := range in_flight {
+		check := old
+		for _, c := range cfg.Checks {
+			if c.Name == old.Name {
+				check = c
+				break
+			}
+		}
+		if old.Persistent() && (check == old || check.Command != old.Command || !check.Persistent()) {
+			check.Stop()
+		}
+		adopted = append(adopted, check)
+	}
+	return adopted
+}
+
+// Stops any persistent checks that are running, and waits for them to exit,
+// submitting their final results to bolo, before bmad shuts down
+func stop_persistent(in_flight [](*bma.Check)) {
+	var stopping [](*bma.Check)
+	for _, check := range in_flight {
+		if check.Persistent() {
+			check.Stop()
+			stopping = append(stopping, check)
+		}
+	}
+	for _, check := range stopping {
+		for !check.Reap() {
+			time.Sleep(TICK)
+		}
+		if err := check.Submit(true); err != nil {
+			log.Errorf("Error submitting check results for %s: %s", check.Name, err.Error())
+		}
+	}
+}
+
+// Starts watching the config files for changes (if enabled in the config),
+// flagging a config reload whenever they change. Any previous watcher is
+// stopped first, so that changes to the watch settings, include_dir, or
+// include paths take effect after a reload.
+func watch_config(watcher *bma.Watcher, reload *bool) *bma.Watcher {
+	if watcher != nil {
+		watcher.Close()
+	}
+	if !cfg.Watch {
+		return nil
+	}
+	watcher, err := bma.WatchConfig(getopt.GetValue("config"), cfg, func() {
+		log.Infof("Configuration file changes detected")
+		*reload = true
+	})
+	if err != nil {
+		log.Errorf("Couldn't watch config files for changes: %s", err.Error())
+		return nil
+	}
+	return watcher
+}
+
+// Starts polling the remote config endpoint (if any) for changes,
+// setting reload when a new config is being served. Any existing
+// poller is stopped first, so that changes to the remote settings
+// take effect after a reload.
+func poll_remote(poller *bma.Poller, reload *bool) *bma.Poller {
+	if poller != nil {
+		poller.Close()
+	}
+	return bma.PollRemote(cfg, func() {
+		log.Infof("Remote configuration changes detected")
+		*reload = true
+	})
+}